@@ -0,0 +1,475 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AppalachianCoding/rpg-app/backend/dice"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// API_PREFIX is where the current version of the API is mounted.
+const API_PREFIX = "/v1"
+
+// The legacy unversioned routes are aliases of API_PREFIX until
+// LEGACY_SUNSET.
+var (
+	LEGACY_DEPRECATED = time.Date(2026, time.October, 18, 0, 0, 0, 0, time.UTC)
+	LEGACY_SUNSET     = time.Date(2027, time.April, 18, 0, 0, 0, 0, time.UTC)
+)
+
+// routeHandler is a handler that needs the database. Method expressions
+// such as DbClient.allHandler have this type.
+type routeHandler func(DbClient, http.ResponseWriter, *http.Request)
+
+// static adapts a handler that doesn't use the database.
+func static(h http.HandlerFunc) routeHandler {
+	return func(_ DbClient, w http.ResponseWriter, r *http.Request) {
+		h(w, r)
+	}
+}
+
+// APIParam is a query parameter an endpoint reads.
+type APIParam struct {
+	Name        string
+	Type        string
+	Description string
+}
+
+// Response kinds, which say what a successful response holds.
+const (
+	// Rows of the table in the path, in any negotiated format.
+	RESPONSE_ROWS = "rows"
+	// One row of the table in the path, in any negotiated format.
+	RESPONSE_RECORD = "record"
+	// Rows shaped by APIRoute.Schema, in any negotiated format.
+	RESPONSE_LIST = "list"
+	// A JSON document shaped by APIRoute.Schema.
+	RESPONSE_JSON = "json"
+	// Plain text.
+	RESPONSE_TEXT = "text"
+	// No body.
+	RESPONSE_NONE = "none"
+)
+
+// APIRoute is one endpoint. newRouter registers it, /capabilities lists it
+// and /openapi.json describes it, so the three can't disagree.
+type APIRoute struct {
+	Path        string
+	Methods     []string
+	Description string
+	Params      []APIParam
+	// Body is the JSON schema of the request body, if there is one.
+	Body     map[string]interface{}
+	Response string
+	// Status is the status of a successful response, when it isn't 200.
+	Status int
+	// Schema is the JSON schema of a RESPONSE_LIST item or RESPONSE_JSON
+	// document.
+	Schema map[string]interface{}
+	// Paged responses carry X-Total-Count and, when there is more,
+	// X-Next-Cursor and Link headers.
+	Paged bool
+	// Conditional responses carry validators tied to the last import and
+	// deploy, and answer conditional requests with 304.
+	Conditional bool
+	// Legacy routes were served before API_PREFIX, and are still served
+	// unversioned until LEGACY_SUNSET.
+	Legacy  bool
+	Handler routeHandler
+}
+
+func (route APIRoute) bind(dbc DbClient) http.HandlerFunc {
+	h := func(w http.ResponseWriter, r *http.Request) {
+		route.Handler(dbc, w, r)
+	}
+	if route.Conditional {
+		return dbc.conditional(h)
+	}
+	return h
+}
+
+var (
+	formatParam = APIParam{"format", "string",
+		"Response format: json (the default), ndjson, csv or yaml. Overrides Accept."}
+	expandParams = []APIParam{
+		{"expand", "string", "Comma separated field paths whose references are " +
+			"replaced by the rows they point to, or * for every reference."},
+		{"depth", "integer", "How many levels of references ?expand= follows, 1 to 3."},
+	}
+	listParams = []APIParam{
+		{"filter", "string", "Selects rows, e.g. \"level<=3 AND school.index=evocation\"."},
+		{"fields", "string", "Comma separated columns to return."},
+		{"sort", "string", "Comma separated columns to order by, - for descending."},
+		{"limit", "integer", "Page size, up to 1000."},
+		{"cursor", "string", "Resumes from the X-Next-Cursor of the previous page."},
+	}
+)
+
+func params(groups ...[]APIParam) []APIParam {
+	var all []APIParam
+	for _, g := range groups {
+		all = append(all, g...)
+	}
+	return all
+}
+
+// apiRoutes lists every endpoint in the order the router tries them, so
+// fixed paths come before the {table} patterns that would also match them.
+func apiRoutes() []APIRoute {
+	return []APIRoute{
+		{
+			Path:        "/health",
+			Methods:     []string{"GET"},
+			Description: "Reports that the server is up.",
+			Response:    RESPONSE_TEXT,
+			Legacy:      true,
+			Handler:     static(healthCheckHandler),
+		},
+		{
+			Path:        "/tables",
+			Methods:     []string{"GET"},
+			Description: "Lists the tables that can be queried.",
+			Response:    RESPONSE_JSON,
+			Schema:      arraySchema(map[string]interface{}{"type": "string"}),
+			Conditional: true,
+			Legacy:      true,
+			Handler:     static(tablesHandler),
+		},
+		{
+			Path:    "/capabilities",
+			Methods: []string{"GET"},
+			Description: "Returns a list of all available API endpoints and their " +
+				"methods and descriptions.",
+			Response: RESPONSE_JSON,
+			Schema:   arraySchema(structSchema(APICapability{})),
+			Legacy:   true,
+			Handler:  static(capabilitiesHandler),
+		},
+		{
+			Path:        "/openapi.json",
+			Methods:     []string{"GET"},
+			Description: "Returns the OpenAPI 3 description of this API.",
+			Response:    RESPONSE_JSON,
+			Schema:      map[string]interface{}{"type": "object"},
+			Conditional: true,
+			Handler:     static(openAPIHandler),
+		},
+		{
+			Path:    "/versions",
+			Methods: []string{"GET"},
+			Description: "Returns the content hash and import time of the " +
+				"dataset behind each table.",
+			Params:      []APIParam{formatParam},
+			Response:    RESPONSE_LIST,
+			Schema:      structSchema(DatasetVersion{}),
+			Conditional: true,
+			Handler:     DbClient.versionsHandler,
+		},
+		{
+			Path:    "/drift",
+			Methods: []string{"GET"},
+			Description: "Lists datasets whose keys no longer match their " +
+				"pinned column mapping.",
+			Response:    RESPONSE_JSON,
+			Schema:      arraySchema(structSchema(DriftReport{})),
+			Conditional: true,
+			Handler:     static(driftHandler),
+		},
+		{
+			Path:    "/cache",
+			Methods: []string{"GET"},
+			Description: "Returns hit, miss and size statistics for the in-memory " +
+				"row cache, when it is enabled with -cache-mb.",
+			Response: RESPONSE_JSON,
+			Schema:   structSchema(CacheStats{}),
+			Handler:  static(cacheHandler),
+		},
+		{
+			Path:    "/search",
+			Methods: []string{"GET"},
+			Description: "Full-text search of the name and description of every " +
+				"record, best match first, with highlighted snippets.",
+			Params: []APIParam{
+				{"q", "string", "The search text."},
+				{"table", "string", "Comma separated tables to search."},
+				{"type", "string", "Only rows of this type, e.g. a monster's \"dragon\"."},
+				{"limit", "integer", "Most results to return, up to 100."},
+				formatParam,
+			},
+			Response:    RESPONSE_LIST,
+			Schema:      searchResultSchema,
+			Conditional: true,
+			Handler:     DbClient.searchHandler,
+		},
+		{
+			Path:    "/all/{table}",
+			Methods: []string{"GET"},
+			Description: "Retrieves all records from a specified table, a page " +
+				"at a time when ?limit= is given.",
+			Params:      params(listParams, expandParams, []APIParam{formatParam}),
+			Response:    RESPONSE_ROWS,
+			Paged:       true,
+			Conditional: true,
+			Legacy:      true,
+			Handler:     DbClient.allHandler,
+		},
+		{
+			Path:        "/capabilities/{table}",
+			Methods:     []string{"GET"},
+			Description: "Returns the columns of a table and their types.",
+			Response:    RESPONSE_JSON,
+			Schema:      structSchema(FiveETable{}),
+			Conditional: true,
+			Legacy:      true,
+			Handler:     static(describeTable),
+		},
+		{
+			Path:    "/suggest/{table}",
+			Methods: []string{"GET"},
+			Description: "Autocomplete for names in a table. Prefix matches come " +
+				"first, then close spellings.",
+			Params: []APIParam{
+				{"q", "string", "The text typed so far."},
+				{"limit", "integer", "Most candidates to return, up to 50."},
+				formatParam,
+			},
+			Response:    RESPONSE_LIST,
+			Schema:      structSchema(Suggestion{}),
+			Conditional: true,
+			Handler:     DbClient.suggestHandler,
+		},
+		{
+			Path:    "/schema/{table}",
+			Methods: []string{"GET"},
+			Description: "Returns a JSON Schema for the rows of a table, inferred " +
+				"from the imported data: nested field types, optional fields, " +
+				"enums and references.",
+			Response:    RESPONSE_JSON,
+			Schema:      map[string]interface{}{"type": "object"},
+			Conditional: true,
+			Handler:     DbClient.schemaHandler,
+		},
+		{
+			Path:    "/graphql",
+			Methods: []string{"GET", "POST"},
+			Description: "GraphQL over every table, with references resolved to " +
+				"the rows they link to. POST takes a JSON body with query, " +
+				"variables and operationName.",
+			Params: []APIParam{
+				{"query", "string", "The GraphQL document, for GET."},
+				{"variables", "string", "JSON object of variable values, for GET."},
+				{"operationName", "string", "Which operation in the document to run, for GET."},
+			},
+			Body:     structSchema(GraphQLRequest{}),
+			Response: RESPONSE_JSON,
+			Schema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"data":   map[string]interface{}{"type": "object"},
+					"errors": arraySchema(map[string]interface{}{"type": "object"}),
+				},
+			},
+			Conditional: true,
+			Handler:     DbClient.graphqlHandler,
+		},
+		{
+			Path:    "/batch",
+			Methods: []string{"POST"},
+			Description: "Looks up many records at once from a JSON list of " +
+				"{table, index} or {table, name}, with one query per table. " +
+				"Results are keyed by each item's id, or its position.",
+			Params:   expandParams,
+			Body:     arraySchema(structSchema(BatchItem{})),
+			Response: RESPONSE_JSON,
+			Schema:   structSchema(BatchResponse{}),
+			Handler:  DbClient.batchHandler,
+		},
+		{
+			Path:        "/characters",
+			Methods:     []string{"GET"},
+			Description: "Lists the saved player characters by name.",
+			Response:    RESPONSE_JSON,
+			Schema:      arraySchema(structSchema(Character{})),
+			Handler:     DbClient.listCharactersHandler,
+		},
+		{
+			Path:    "/characters",
+			Methods: []string{"POST"},
+			Description: "Saves a new player character. Its race, subrace, classes, " +
+				"subclasses, background, ability scores, equipment and spells " +
+				"must name SRD records by index.",
+			Body:     structSchema(Character{}),
+			Response: RESPONSE_JSON,
+			Status:   http.StatusCreated,
+			Schema:   structSchema(Character{}),
+			Handler:  DbClient.createCharacterHandler,
+		},
+		{
+			Path:        "/characters/{id}",
+			Methods:     []string{"GET"},
+			Description: "Retrieves a saved player character.",
+			Response:    RESPONSE_JSON,
+			Schema:      structSchema(Character{}),
+			Handler:     DbClient.getCharacterHandler,
+		},
+		{
+			Path:    "/characters/{id}",
+			Methods: []string{"PUT"},
+			Description: "Replaces a saved player character, checking its " +
+				"references as when it was created.",
+			Body:     structSchema(Character{}),
+			Response: RESPONSE_JSON,
+			Schema:   structSchema(Character{}),
+			Handler:  DbClient.updateCharacterHandler,
+		},
+		{
+			Path:        "/characters/{id}",
+			Methods:     []string{"DELETE"},
+			Description: "Deletes a saved player character.",
+			Response:    RESPONSE_NONE,
+			Status:      http.StatusNoContent,
+			Handler:     DbClient.deleteCharacterHandler,
+		},
+		{
+			Path:    "/roll",
+			Methods: []string{"GET"},
+			Description: "Rolls dice notation such as 18d10+36, 4d6kh3 or d20adv+5, " +
+				"with rerolls (r, ro) and exploding dice (!). Returns every die " +
+				"and the total.",
+			Params: []APIParam{
+				{"expr", "string", "The dice expression."},
+				{"seed", "integer", "Repeats the roll with this seed from an earlier result."},
+			},
+			Response: RESPONSE_JSON,
+			Schema:   structSchema(dice.Result{}),
+			Handler:  static(rollHandler),
+		},
+		{
+			Path:        "/",
+			Methods:     []string{"GET"},
+			Description: "Reports that the server is up.",
+			Response:    RESPONSE_TEXT,
+			Legacy:      true,
+			Handler:     static(healthCheckHandler),
+		},
+		{
+			Path:    "/{table}/{index}/references",
+			Methods: []string{"GET"},
+			Description: "Lists the rows that reference an entry, grouped by " +
+				"table and field path.",
+			Response:    RESPONSE_JSON,
+			Schema:      referencesSchema,
+			Conditional: true,
+			Handler:     DbClient.referencesHandler,
+		},
+		{
+			Path:        "/{table}/{index}",
+			Methods:     []string{"GET"},
+			Description: "Retrieves the record with the given index slug.",
+			Params:      params(expandParams, []APIParam{formatParam}),
+			Response:    RESPONSE_RECORD,
+			Conditional: true,
+			Handler:     DbClient.lookupHandler,
+		},
+		{
+			Path:    "/{table}/{name}",
+			Methods: []string{"POST"},
+			Description: "Retrieves the record with the given display name, " +
+				"ignoring case. Nothing is written.",
+			Params:   params(expandParams, []APIParam{formatParam}),
+			Response: RESPONSE_RECORD,
+			Legacy:   true,
+			Handler:  DbClient.apiHandler,
+		},
+		{
+			Path:    "/{table}",
+			Methods: []string{"GET"},
+			Description: "Retrieves the names of the records in a table, or " +
+				"other columns with ?fields=.",
+			Params:      params(listParams, []APIParam{formatParam}),
+			Response:    RESPONSE_ROWS,
+			Paged:       true,
+			Conditional: true,
+			Legacy:      true,
+			Handler:     DbClient.getAllNamesHandler,
+		},
+	}
+}
+
+// reservedNames are the first path segments of the fixed endpoints, such as
+// search, and API_PREFIX itself.
+var reservedNames = sync.OnceValue(func() map[string]bool {
+	names := map[string]bool{strings.TrimPrefix(API_PREFIX, "/"): true}
+	for _, route := range apiRoutes() {
+		if first := firstSegment(route.Path); first != "" && !strings.HasPrefix(first, "{") {
+			names[first] = true
+		}
+	}
+	return names
+})
+
+func firstSegment(path string) string {
+	return strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)[0]
+}
+
+// reservedName reports whether a table of that name would be confused with
+// an endpoint, such as search.
+func reservedName(name string) bool {
+	return reservedNames()[name]
+}
+
+// notReserved keeps a route whose path starts with {table} from answering
+// for an endpoint's name, so that path is left to the endpoint or, where it
+// isn't served, to noRouteHandler. Any other name reaches the handler, which
+// reports it as invalid_table.
+func notReserved(prefix string) mux.MatcherFunc {
+	return func(r *http.Request, _ *mux.RouteMatch) bool {
+		return !reservedName(firstSegment(strings.TrimPrefix(r.URL.EscapedPath(), prefix)))
+	}
+}
+
+// deprecated marks a response from a legacy route with its Deprecation (RFC
+// 9745) and Sunset (RFC 8594) dates and a link to the same path under
+// API_PREFIX.
+func deprecated(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		successor := API_PREFIX + r.URL.EscapedPath()
+		if r.URL.RawQuery != "" {
+			successor += "?" + r.URL.RawQuery
+		}
+
+		h := w.Header()
+		h.Set("Deprecation", fmt.Sprintf("@%d", LEGACY_DEPRECATED.Unix()))
+		h.Set("Sunset", LEGACY_SUNSET.Format(http.TimeFormat))
+		h.Add("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", successor))
+		next(w, r)
+	}
+}
+
+type APICapability struct {
+	Path        string   `json:"path"`
+	Methods     []string `json:"methods"`
+	Description string   `json:"description,omitempty"`
+}
+
+func capabilitiesHandler(w http.ResponseWriter, r *http.Request) {
+	logrus.WithFields(logrus.Fields{
+		"method": "capabilities",
+		"ip":     r.RemoteAddr,
+	}).Info("Received request for capabilities")
+
+	routes := apiRoutes()
+	capabilities := make([]APICapability, len(routes))
+	for i, route := range routes {
+		capabilities[i] = APICapability{API_PREFIX + route.Path, route.Methods, route.Description}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(capabilities)
+}
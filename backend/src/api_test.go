@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestReservedName(t *testing.T) {
+	for name, reserved := range map[string]bool{
+		"search": true,
+		"all":    true,
+		"v1":     true,
+		"spells": false,
+	} {
+		if reservedName(name) != reserved {
+			t.Errorf("Expected reservedName(%q) to be %v", name, reserved)
+		}
+	}
+}
+
+func TestSqliteVersionedRoutes(t *testing.T) {
+	srv := newSqliteTestServer(t)
+
+	res, err := http.Get(srv.URL + "/v1/spells/fireball")
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", res.StatusCode)
+	}
+	if res.Header.Get("Deprecation") != "" {
+		t.Error("Expected no Deprecation header under /v1")
+	}
+
+	res, err = http.Get(srv.URL + "/spells?fields=name")
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200 from the legacy route, got %d", res.StatusCode)
+	}
+	if !strings.HasPrefix(res.Header.Get("Deprecation"), "@") || res.Header.Get("Sunset") == "" {
+		t.Errorf("Expected Deprecation and Sunset headers, got %v", res.Header)
+	}
+	if link := res.Header.Get("Link"); !strings.Contains(link, `</v1/spells?fields=name>; rel="successor-version"`) {
+		t.Errorf("Expected a successor-version link, got %q", link)
+	}
+
+	// Endpoints added under /v1 have no unversioned alias.
+	for _, path := range []string{"/roll?expr=1d6", "/search?q=fire", "/spells/fireball"} {
+		res, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusNotFound && res.StatusCode != http.StatusMethodNotAllowed {
+			t.Errorf("%s: Expected no legacy route, got %d", path, res.StatusCode)
+		}
+	}
+
+	// Endpoint names are left for the endpoints, and any other name is an
+	// invalid table.
+	for path, code := range map[string]string{
+		"/v1/search/fireball":      ERR_NO_ROUTE,
+		"/v1/not_a_table/fireball": ERR_INVALID_TABLE,
+	} {
+		res, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		var body ErrorEnvelope
+		err = json.NewDecoder(res.Body).Decode(&body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatalf("Failed to decode error: %v", err)
+		}
+		if body.Error.Code != code {
+			t.Errorf("%s: Expected %s, got %d %s", path, code, res.StatusCode, body.Error.Code)
+		}
+	}
+}
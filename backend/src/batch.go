@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	MAX_BATCH_ITEMS = 100
+	MAX_BATCH_BYTES = 1 << 20
+)
+
+// BatchItem asks for one row by index or, ignoring case, by name. Its result
+// is keyed by ID, or by its position in the batch when there is no ID.
+type BatchItem struct {
+	ID    string `json:"id,omitempty"`
+	Table string `json:"table"`
+	Index string `json:"index,omitempty"`
+	Name  string `json:"name,omitempty"`
+}
+
+// BatchResult holds the row a BatchItem asked for, or why there isn't one.
+type BatchResult struct {
+	Table string                 `json:"table"`
+	Index string                 `json:"index,omitempty"`
+	Name  string                 `json:"name,omitempty"`
+	Data  map[string]interface{} `json:"data,omitempty"`
+	Error *APIError              `json:"error,omitempty"`
+}
+
+type BatchResponse struct {
+	Results map[string]BatchResult `json:"results"`
+}
+
+// batchQuery selects the rows of a table matching any of the items, which
+// are all for that table.
+func batchQuery(table string, items []BatchItem) (string, []interface{}) {
+	var indexes, names []string
+	var params []interface{}
+	for _, item := range items {
+		params = append(params, item.Index+item.Name)
+		placeholder := fmt.Sprintf("$%d", len(params))
+		if item.Index != "" {
+			indexes = append(indexes, placeholder)
+		} else {
+			names = append(names, "lower("+placeholder+")")
+		}
+	}
+
+	var conditions []string
+	if len(indexes) > 0 {
+		conditions = append(conditions, "_index IN ("+strings.Join(indexes, ", ")+")")
+	}
+	if len(names) > 0 {
+		conditions = append(conditions, "lower(name) IN ("+strings.Join(names, ", ")+")")
+	}
+	return fmt.Sprintf("SELECT * FROM %s WHERE %s", table, strings.Join(conditions, " OR ")), params
+}
+
+// batchHandler serves POST /batch, looking up many rows with one query per
+// table. Items that can't be found get an error of their own.
+func (dbc DbClient) batchHandler(w http.ResponseWriter, r *http.Request) {
+	log := logrus.WithFields(logrus.Fields{
+		"method": "batch",
+		"ip":     r.RemoteAddr,
+	})
+	log.Debug("Received batch request")
+
+	sel, err := parseExpand(r.URL.Query())
+	if err != nil {
+		log.WithError(err).Warn("Invalid expand")
+		writeInvalidParameter(w, r, err)
+		return
+	}
+
+	var items []BatchItem
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MAX_BATCH_BYTES)).Decode(&items); err != nil {
+		log.WithError(err).Warn("Invalid batch")
+		writeError(w, r, http.StatusBadRequest, ERR_INVALID_BODY,
+			"Expected a JSON list of {table, index} or {table, name}", nil)
+		return
+	}
+	if len(items) == 0 || len(items) > MAX_BATCH_ITEMS {
+		log.Warnf("Batch of %d items\n", len(items))
+		writeError(w, r, http.StatusBadRequest, ERR_INVALID_BODY,
+			fmt.Sprintf("A batch must have between 1 and %d items", MAX_BATCH_ITEMS), nil)
+		return
+	}
+
+	requestID := w.Header().Get(REQUEST_ID_HEADER)
+	itemError := func(code string, message string, details map[string]interface{}) *APIError {
+		return &APIError{Code: code, Message: message, RequestID: requestID, Details: details}
+	}
+
+	results := make(map[string]BatchResult, len(items))
+	keys := make([]string, len(items))
+	byTable := make(map[string][]BatchItem)
+	for i, item := range items {
+		key := item.ID
+		if key == "" {
+			key = strconv.Itoa(i)
+		}
+		if _, ok := results[key]; ok {
+			log.Warnf("Duplicate batch id %s\n", key)
+			writeError(w, r, http.StatusBadRequest, ERR_INVALID_BODY, "Batch ids must be unique",
+				map[string]interface{}{"id": key})
+			return
+		}
+		keys[i] = key
+
+		result := BatchResult{Table: item.Table, Index: item.Index, Name: item.Name}
+		switch {
+		case !verifyTable(item.Table):
+			result.Error = itemError(ERR_INVALID_TABLE, "Invalid table", map[string]interface{}{
+				"table":  item.Table,
+				"tables": TABLE_NAMES,
+			})
+		case (item.Index == "") == (item.Name == ""):
+			result.Error = itemError(ERR_INVALID_PARAMETER, "Give one of index or name", nil)
+		default:
+			byTable[item.Table] = append(byTable[item.Table], item)
+		}
+		results[key] = result
+	}
+
+	var found []map[string]interface{}
+	tables := make([]string, 0, len(byTable))
+	for table := range byTable {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	for _, table := range tables {
+		query, params := batchQuery(table, byTable[table])
+		rows, err := queryMaps(dbc.DB, query, params...)
+		if err != nil {
+			log.WithError(err).WithField("table", table).Warn("Failed to query database")
+			writeInternalError(w, r, "Failed to query database")
+			return
+		}
+		byIndex := make(map[string]map[string]interface{}, len(rows))
+		byName := make(map[string]map[string]interface{}, len(rows))
+		for _, row := range rows {
+			if index, ok := row["index"].(string); ok {
+				byIndex[index] = row
+			}
+			if name, ok := row["name"].(string); ok {
+				byName[strings.ToLower(name)] = row
+			}
+		}
+
+		seen := make(map[interface{}]bool)
+		for i, item := range items {
+			if item.Table != table || results[keys[i]].Error != nil {
+				continue
+			}
+			result := results[keys[i]]
+			if item.Index != "" {
+				result.Data = byIndex[item.Index]
+			} else {
+				result.Data = byName[strings.ToLower(item.Name)]
+			}
+			if result.Data == nil {
+				result.Error = itemError(ERR_NOT_FOUND, "No results", nil)
+			} else if !seen[result.Data["index"]] {
+				// Rows asked for twice are the same map, so only expand them once.
+				seen[result.Data["index"]] = true
+				found = append(found, result.Data)
+			}
+			results[keys[i]] = result
+		}
+	}
+
+	if sel != nil && len(found) > 0 {
+		if err := expandRows(found, sel, dbc.fetchReferences); err != nil {
+			log.WithError(err).Warn("Failed to expand references")
+			writeInternalError(w, r, "Failed to expand references")
+			return
+		}
+	}
+
+	log.WithFields(logrus.Fields{
+		"items":  len(items),
+		"tables": len(tables),
+	}).Info("Finished batch")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(BatchResponse{results})
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestBatchQuery(t *testing.T) {
+	query, params := batchQuery("spells", []BatchItem{
+		{Table: "spells", Index: "fireball"},
+		{Table: "spells", Name: "Magic Missile"},
+		{Table: "spells", Index: "wish"},
+	})
+	expected := "SELECT * FROM spells WHERE _index IN ($1, $3) OR lower(name) IN (lower($2))"
+	if query != expected {
+		t.Errorf("Expected %q, got %q", expected, query)
+	}
+	if !reflect.DeepEqual(params, []interface{}{"fireball", "Magic Missile", "wish"}) {
+		t.Errorf("Unexpected params %v", params)
+	}
+}
+
+func TestSqliteBatch(t *testing.T) {
+	srv := newSqliteTestServer(t)
+
+	post := func(body string) (*http.Response, BatchResponse) {
+		res, err := http.Post(srv.URL+"/v1/batch?expand=school", "application/json", bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		defer res.Body.Close()
+		var batch BatchResponse
+		json.NewDecoder(res.Body).Decode(&batch)
+		return res, batch
+	}
+
+	res, batch := post(`[
+		{"id": "spell", "table": "spells", "index": "fireball"},
+		{"id": "race", "table": "races", "name": "ELF"},
+		{"table": "spells", "name": "fireball"},
+		{"table": "spells", "index": "not-a-spell"},
+		{"table": "not_a_table", "index": "fireball"},
+		{"table": "spells", "index": "fireball", "name": "Fireball"}
+	]`)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", res.StatusCode)
+	}
+
+	if spell := batch.Results["spell"].Data; spell["name"] != "Fireball" {
+		t.Errorf("Expected Fireball, got %v", batch.Results["spell"])
+	} else if school, _ := spell["school"].(map[string]interface{}); school["desc"] == nil {
+		t.Errorf("Expected the school to be expanded, got %v", spell["school"])
+	}
+	if batch.Results["race"].Data["index"] != "elf" {
+		t.Errorf("Expected elf by name, got %v", batch.Results["race"])
+	}
+	if batch.Results["2"].Data["index"] != "fireball" {
+		t.Errorf("Expected fireball by name keyed by position, got %v", batch.Results["2"])
+	}
+
+	errors := map[string]string{"3": ERR_NOT_FOUND, "4": ERR_INVALID_TABLE, "5": ERR_INVALID_PARAMETER}
+	for key, code := range errors {
+		result := batch.Results[key]
+		if result.Error == nil || result.Error.Code != code || result.Data != nil {
+			t.Errorf("Expected item %s to fail with %s, got %+v", key, code, result)
+		}
+	}
+
+	res, _ = post(`[{"id": "a", "table": "spells", "index": "wish"}, {"id": "a", "table": "spells", "index": "fireball"}]`)
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected duplicate ids to be rejected, got %d", res.StatusCode)
+	}
+	res, _ = post(`{"table": "spells"}`)
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected a body that isn't a list to be rejected, got %d", res.StatusCode)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ROW_CACHE is the optional read-through cache in front of table queries.
+// It is nil unless enabled in the config; its methods treat nil as a cache
+// that never hits.
+var ROW_CACHE *RowCache
+
+type cacheKey struct {
+	Table  string
+	Query  string
+	Params string
+}
+
+type cacheEntry struct {
+	key   cacheKey
+	value interface{}
+	size  int
+}
+
+// CacheStats are served at /cache.
+type CacheStats struct {
+	Enabled       bool  `json:"enabled"`
+	MaxBytes      int   `json:"max_bytes"`
+	Bytes         int   `json:"bytes"`
+	Entries       int   `json:"entries"`
+	Hits          int64 `json:"hits"`
+	Misses        int64 `json:"misses"`
+	Evictions     int64 `json:"evictions"`
+	Invalidations int64 `json:"invalidations"`
+}
+
+// RowCache holds query results for the SRD tables, keyed by table, query and
+// parameters, which for lookups are the index or name. The least recently
+// used results are evicted to stay under maxBytes, and a table's results are
+// dropped when it is imported.
+type RowCache struct {
+	mu       sync.Mutex
+	maxBytes int
+	order    *list.List
+	entries  map[cacheKey]*list.Element
+	stats    CacheStats
+}
+
+func newRowCache(maxBytes int) *RowCache {
+	return &RowCache{
+		maxBytes: maxBytes,
+		order:    list.New(),
+		entries:  make(map[cacheKey]*list.Element),
+	}
+}
+
+func newCacheKey(table string, query string, params []interface{}) cacheKey {
+	return cacheKey{table, query, fmt.Sprintf("%q", params)}
+}
+
+func (c *RowCache) get(key cacheKey) (interface{}, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		c.order.MoveToFront(el)
+		c.stats.Hits++
+		return el.Value.(*cacheEntry).value, true
+	}
+	c.stats.Misses++
+	return nil, false
+}
+
+// put stores a result the caller must not modify afterwards. Results bigger
+// than the whole cache are not kept.
+func (c *RowCache) put(key cacheKey, value interface{}, size int) {
+	if c == nil || size > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{key, value, size})
+	c.stats.Bytes += size
+
+	for c.stats.Bytes > c.maxBytes {
+		c.remove(c.order.Back())
+		c.stats.Evictions++
+	}
+}
+
+func (c *RowCache) remove(el *list.Element) {
+	entry := c.order.Remove(el).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.stats.Bytes -= entry.size
+}
+
+// invalidate drops every result read from a table.
+func (c *RowCache) invalidate(table string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, el := range c.entries {
+		if key.Table == table {
+			c.remove(el)
+		}
+	}
+	c.stats.Invalidations++
+}
+
+func (c *RowCache) Stats() CacheStats {
+	if c == nil {
+		return CacheStats{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.stats
+	stats.Enabled = true
+	stats.MaxBytes = c.maxBytes
+	stats.Entries = len(c.entries)
+	return stats
+}
+
+// rowsSize estimates the memory held by decoded rows from their JSON size.
+func rowsSize(rows []map[string]interface{}) int {
+	data, err := json.Marshal(rows)
+	if err != nil {
+		return 0
+	}
+	return len(data)
+}
+
+// queryMapsCached is queryMaps through ROW_CACHE. The rows returned are
+// shared with the cache, so callers that change them must clone them first.
+func (dbc DbClient) queryMapsCached(table string, query string, params ...interface{}) ([]map[string]interface{}, error) {
+	key := newCacheKey(table, query, params)
+	if rows, ok := ROW_CACHE.get(key); ok {
+		return rows.([]map[string]interface{}), nil
+	}
+
+	rows, err := queryMaps(dbc.DB, query, params...)
+	if err != nil {
+		return nil, err
+	}
+	if ROW_CACHE != nil {
+		ROW_CACHE.put(key, rows, rowsSize(rows))
+	}
+	return rows, nil
+}
+
+func cacheHandler(w http.ResponseWriter, r *http.Request) {
+	logrus.WithFields(logrus.Fields{
+		"method": "cache",
+		"ip":     r.RemoteAddr,
+	}).Info("Received request for cache stats")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ROW_CACHE.Stats())
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestRowCacheEvictsAndInvalidates(t *testing.T) {
+	c := newRowCache(100)
+	c.put(newCacheKey("spells", "a", nil), "a", 40)
+	c.put(newCacheKey("spells", "b", nil), "b", 40)
+	if _, ok := c.get(newCacheKey("spells", "a", nil)); !ok {
+		t.Fatal("Expected a hit for a")
+	}
+
+	// b is now the least recently used, so it makes room for c.
+	c.put(newCacheKey("monsters", "c", nil), "c", 40)
+	if _, ok := c.get(newCacheKey("spells", "b", nil)); ok {
+		t.Error("Expected b to be evicted")
+	}
+	c.put(newCacheKey("spells", "too big", nil), "x", 101)
+
+	c.invalidate("spells")
+	if _, ok := c.get(newCacheKey("spells", "a", nil)); ok {
+		t.Error("Expected a to be invalidated")
+	}
+	if _, ok := c.get(newCacheKey("monsters", "c", nil)); !ok {
+		t.Error("Expected c to survive invalidating spells")
+	}
+
+	stats := c.Stats()
+	if stats.Entries != 1 || stats.Bytes != 40 || stats.Hits != 2 || stats.Misses != 2 || stats.Evictions != 1 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+
+	var disabled *RowCache
+	disabled.put(newCacheKey("spells", "a", nil), "a", 1)
+	if _, ok := disabled.get(newCacheKey("spells", "a", nil)); ok || disabled.Stats().Enabled {
+		t.Error("Expected a nil cache to never hit")
+	}
+}
+
+func TestSqliteRowCache(t *testing.T) {
+	ROW_CACHE = newRowCache(64 << 20)
+	t.Cleanup(func() { ROW_CACHE = nil })
+	srv := newSqliteTestServer(t)
+
+	get := func(path string) string {
+		res, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("%s: expected status 200, got %d", path, res.StatusCode)
+		}
+		body, _ := io.ReadAll(res.Body)
+		return string(body)
+	}
+
+	paths := []string{"/v1/spells/fireball", "/v1/all/spells?limit=10", "/v1/spells", "/v1/spells/fireball?expand=school"}
+	first := make(map[string]string)
+	for _, path := range paths {
+		first[path] = get(path)
+	}
+	before := ROW_CACHE.Stats()
+	for _, path := range paths {
+		if body := get(path); body != first[path] {
+			t.Errorf("%s: cached response differs", path)
+		}
+	}
+	after := ROW_CACHE.Stats()
+	if after.Misses != before.Misses || after.Hits <= before.Hits {
+		t.Errorf("Expected only hits the second time, got %+v then %+v", before, after)
+	}
+
+	res, err := http.Get(srv.URL + "/v1/cache")
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	defer res.Body.Close()
+	var stats CacheStats
+	if err := json.NewDecoder(res.Body).Decode(&stats); err != nil || !stats.Enabled || stats.Entries == 0 {
+		t.Errorf("Expected cache stats, got %+v (%v)", stats, err)
+	}
+
+	ROW_CACHE.invalidate("spells")
+	get("/v1/spells/fireball")
+	if ROW_CACHE.Stats().Misses == after.Misses {
+		t.Error("Expected a miss after invalidating spells")
+	}
+}
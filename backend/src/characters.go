@@ -0,0 +1,512 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// CHARACTERS_TABLE holds player characters. Unlike the SRD tables it is
+// never dropped by an import.
+const CHARACTERS_TABLE = "characters"
+
+const (
+	MAX_CHARACTER_BYTES = 64 << 10
+	MAX_CHARACTER_NAME  = 100
+	MAX_CHARACTER_LEVEL = 20
+	MIN_ABILITY_SCORE   = 1
+	MAX_ABILITY_SCORE   = 30
+)
+
+// CHARACTER_REFERENCES lists, for each kind of SRD row a character can
+// name, the url shapes (see urlPattern) of the tables holding those rows.
+var CHARACTER_REFERENCES = map[string][]string{
+	"race":          {"races/*"},
+	"subrace":       {"subraces/*"},
+	"class":         {"classes/*"},
+	"subclass":      {"subclasses/*"},
+	"background":    {"backgrounds/*"},
+	"ability score": {"ability-scores/*"},
+	"equipment":     {"equipment/*", "magic-items/*"},
+	"spell":         {"spells/*"},
+}
+
+type CharacterClass struct {
+	Class    string `json:"class"`
+	Subclass string `json:"subclass,omitempty"`
+	Level    int    `json:"level"`
+}
+
+type CharacterItem struct {
+	Equipment string `json:"equipment"`
+	Quantity  int    `json:"quantity"`
+}
+
+// Character is a player character. Its race, classes, background, ability
+// scores, equipment and spells name SRD rows by index. Level is the sum of
+// the class levels; it and the id and timestamps are set by the server.
+type Character struct {
+	ID            string           `json:"id"`
+	Name          string           `json:"name"`
+	Race          string           `json:"race"`
+	Subrace       string           `json:"subrace,omitempty"`
+	Classes       []CharacterClass `json:"classes"`
+	Level         int              `json:"level"`
+	Background    string           `json:"background,omitempty"`
+	AbilityScores map[string]int   `json:"ability_scores"`
+	Equipment     []CharacterItem  `json:"equipment"`
+	Spells        []string         `json:"spells"`
+	CreatedAt     time.Time        `json:"created_at"`
+	UpdatedAt     time.Time        `json:"updated_at"`
+}
+
+func createCharactersTable(db *sql.DB) error {
+	dialect := dialectFor(db)
+	query := "CREATE TABLE IF NOT EXISTS " + CHARACTERS_TABLE + " (" +
+		"id TEXT PRIMARY KEY, " +
+		"name TEXT NOT NULL, " +
+		"data " + dialect.ColumnType(JSONB) + " NOT NULL, " +
+		"created_at " + dialect.ColumnType(TIMESTAMP) + " NOT NULL, " +
+		"updated_at " + dialect.ColumnType(TIMESTAMP) + " NOT NULL);"
+
+	if _, err := db.Exec(query); err != nil {
+		logrus.WithError(err).Error("Failed to create characters table")
+		return err
+	}
+	return nil
+}
+
+func newCharacterID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// normalize fills in defaults and the level, and returns the problems with
+// each field that don't need the database to spot.
+func (c *Character) normalize() map[string]string {
+	problems := make(map[string]string)
+
+	c.Name = strings.TrimSpace(c.Name)
+	if c.Name == "" {
+		problems["name"] = "Name is required"
+	} else if utf8.RuneCountInString(c.Name) > MAX_CHARACTER_NAME {
+		problems["name"] = fmt.Sprintf("Name is longer than %d characters", MAX_CHARACTER_NAME)
+	}
+	if c.Race == "" {
+		problems["race"] = "Race is required"
+	}
+
+	c.Level = 0
+	if len(c.Classes) == 0 {
+		problems["classes"] = "At least one class is required"
+	}
+	seen := make(map[string]bool)
+	for i, class := range c.Classes {
+		field := fmt.Sprintf("classes[%d]", i)
+		switch {
+		case class.Class == "":
+			problems[field+".class"] = "Class is required"
+		case seen[class.Class]:
+			problems[field+".class"] = "Class is listed more than once"
+		}
+		seen[class.Class] = true
+		if class.Level < 1 || class.Level > MAX_CHARACTER_LEVEL {
+			problems[field+".level"] = fmt.Sprintf("Level must be between 1 and %d", MAX_CHARACTER_LEVEL)
+		}
+		c.Level += class.Level
+	}
+	if c.Level > MAX_CHARACTER_LEVEL {
+		problems["level"] = fmt.Sprintf("Class levels add up to more than %d", MAX_CHARACTER_LEVEL)
+	}
+
+	if c.AbilityScores == nil {
+		c.AbilityScores = map[string]int{}
+	}
+	for ability, score := range c.AbilityScores {
+		if score < MIN_ABILITY_SCORE || score > MAX_ABILITY_SCORE {
+			problems["ability_scores."+ability] = fmt.Sprintf("Score must be between %d and %d",
+				MIN_ABILITY_SCORE, MAX_ABILITY_SCORE)
+		}
+	}
+
+	if c.Equipment == nil {
+		c.Equipment = []CharacterItem{}
+	}
+	for i := range c.Equipment {
+		item := &c.Equipment[i]
+		field := fmt.Sprintf("equipment[%d]", i)
+		if item.Equipment == "" {
+			problems[field+".equipment"] = "Equipment is required"
+		}
+		if item.Quantity == 0 {
+			item.Quantity = 1
+		} else if item.Quantity < 0 {
+			problems[field+".quantity"] = "Quantity must be positive"
+		}
+	}
+
+	if c.Spells == nil {
+		c.Spells = []string{}
+	}
+	seen = make(map[string]bool)
+	for i, spell := range c.Spells {
+		if seen[spell] {
+			problems[fmt.Sprintf("spells[%d]", i)] = "Spell is listed more than once"
+		}
+		seen[spell] = true
+	}
+
+	return problems
+}
+
+// characterRef is one SRD row a character names, and the field naming it.
+type characterRef struct {
+	Field string
+	Kind  string
+	Index string
+}
+
+func (c *Character) references() []characterRef {
+	var refs []characterRef
+	add := func(field string, kind string, index string) {
+		if index != "" {
+			refs = append(refs, characterRef{field, kind, index})
+		}
+	}
+
+	add("race", "race", c.Race)
+	add("subrace", "subrace", c.Subrace)
+	for i, class := range c.Classes {
+		add(fmt.Sprintf("classes[%d].class", i), "class", class.Class)
+		add(fmt.Sprintf("classes[%d].subclass", i), "subclass", class.Subclass)
+	}
+	add("background", "background", c.Background)
+	for ability := range c.AbilityScores {
+		add("ability_scores."+ability, "ability score", ability)
+	}
+	for i, item := range c.Equipment {
+		add(fmt.Sprintf("equipment[%d].equipment", i), "equipment", item.Equipment)
+	}
+	for i, spell := range c.Spells {
+		add(fmt.Sprintf("spells[%d]", i), "spell", spell)
+	}
+	return refs
+}
+
+// parentIndex is the index of the row a subrace or subclass belongs to.
+func parentIndex(row map[string]interface{}, key string) string {
+	parent, _ := row[key].(map[string]interface{})
+	index, _ := parent["index"].(string)
+	return index
+}
+
+// checkReferences adds a problem for each SRD row the character names that
+// doesn't exist, or that belongs to a different race or class. Each table
+// is queried once.
+func (dbc DbClient) checkReferences(c *Character, problems map[string]string) error {
+	refs := c.references()
+
+	byTable := make(map[string][]BatchItem)
+	queued := make(map[string]bool)
+	for _, ref := range refs {
+		for _, pattern := range CHARACTER_REFERENCES[ref.Kind] {
+			for _, table := range URL_PATTERNS[pattern] {
+				if key := table + "/" + ref.Index; !queued[key] {
+					queued[key] = true
+					byTable[table] = append(byTable[table], BatchItem{Table: table, Index: ref.Index})
+				}
+			}
+		}
+	}
+
+	tables := make([]string, 0, len(byTable))
+	for table := range byTable {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+
+	rows := make(map[string]map[string]interface{})
+	for _, table := range tables {
+		query, params := batchQuery(table, byTable[table])
+		found, err := queryMaps(dbc.DB, query, params...)
+		if err != nil {
+			return err
+		}
+		for _, row := range found {
+			if index, ok := row["index"].(string); ok {
+				rows[table+"/"+index] = row
+			}
+		}
+	}
+
+	classes := make(map[string]bool)
+	for _, class := range c.Classes {
+		classes[class.Class] = true
+	}
+	for _, ref := range refs {
+		var row map[string]interface{}
+		for _, pattern := range CHARACTER_REFERENCES[ref.Kind] {
+			for _, table := range URL_PATTERNS[pattern] {
+				if row == nil {
+					row = rows[table+"/"+ref.Index]
+				}
+			}
+		}
+
+		switch {
+		case row == nil:
+			problems[ref.Field] = fmt.Sprintf("No %s %q", ref.Kind, ref.Index)
+		case ref.Kind == "subrace" && parentIndex(row, "race") != c.Race:
+			problems[ref.Field] = fmt.Sprintf("%q is not a subrace of %q", ref.Index, c.Race)
+		case ref.Kind == "subclass" && !classes[parentIndex(row, "class")]:
+			problems[ref.Field] = fmt.Sprintf("%q is a subclass of %q", ref.Index, parentIndex(row, "class"))
+		}
+	}
+	return nil
+}
+
+// readCharacter decodes and checks the character in a request body,
+// writing the error response if it isn't valid.
+func (dbc DbClient) readCharacter(w http.ResponseWriter, r *http.Request, log *logrus.Entry) (*Character, bool) {
+	var c Character
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, MAX_CHARACTER_BYTES))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&c); err != nil {
+		log.WithError(err).Warn("Invalid character")
+		writeError(w, r, http.StatusBadRequest, ERR_INVALID_BODY, "Expected a JSON character", map[string]interface{}{
+			"cause": err.Error(),
+		})
+		return nil, false
+	}
+
+	problems := c.normalize()
+	if err := dbc.checkReferences(&c, problems); err != nil {
+		log.WithError(err).Warn("Failed to query database")
+		writeInternalError(w, r, "Failed to query database")
+		return nil, false
+	}
+	if len(problems) > 0 {
+		log.WithField("problems", problems).Warn("Invalid character")
+		writeError(w, r, http.StatusBadRequest, ERR_INVALID_BODY, "Invalid character", map[string]interface{}{
+			"fields": problems,
+		})
+		return nil, false
+	}
+	return &c, true
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanCharacter(row rowScanner) (Character, error) {
+	var c Character
+	var data []byte
+	var id string
+	var createdAt, updatedAt time.Time
+	if err := row.Scan(&id, &data, &createdAt, &updatedAt); err != nil {
+		return c, err
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return c, err
+	}
+	c.ID, c.CreatedAt, c.UpdatedAt = id, createdAt, updatedAt
+	return c, nil
+}
+
+const selectCharacters = "SELECT id, data, created_at, updated_at FROM " + CHARACTERS_TABLE
+
+func writeCharacter(w http.ResponseWriter, status int, c Character) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(c)
+}
+
+func writeNoCharacter(w http.ResponseWriter, r *http.Request, id string) {
+	writeError(w, r, http.StatusNotFound, ERR_NOT_FOUND, "No such character", map[string]interface{}{
+		"id": id,
+	})
+}
+
+func (dbc DbClient) listCharactersHandler(w http.ResponseWriter, r *http.Request) {
+	log := logrus.WithFields(logrus.Fields{
+		"method": "listCharacters",
+		"ip":     r.RemoteAddr,
+	})
+	log.Debug("Received request for characters")
+
+	rows, err := dbc.Query(selectCharacters + " ORDER BY lower(name), id")
+	if err != nil {
+		log.WithError(err).Warn("Failed to query database")
+		writeInternalError(w, r, "Failed to query database")
+		return
+	}
+	defer rows.Close()
+
+	characters := []Character{}
+	for rows.Next() {
+		c, err := scanCharacter(rows)
+		if err != nil {
+			log.WithError(err).Warn("Failed to read character")
+			writeInternalError(w, r, "Failed to read characters")
+			return
+		}
+		characters = append(characters, c)
+	}
+	if err := rows.Err(); err != nil {
+		log.WithError(err).Warn("Failed to query database")
+		writeInternalError(w, r, "Failed to query database")
+		return
+	}
+
+	log.Infof("Listed %d characters", len(characters))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(characters)
+}
+
+func (dbc DbClient) getCharacterHandler(w http.ResponseWriter, r *http.Request) {
+	id, _ := url.PathUnescape(mux.Vars(r)["id"])
+	log := logrus.WithFields(logrus.Fields{
+		"id":     id,
+		"method": "getCharacter",
+		"ip":     r.RemoteAddr,
+	})
+	log.Debug("Received request for character")
+
+	c, err := scanCharacter(dbc.QueryRow(selectCharacters+" WHERE id = $1", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		log.Warn("No such character")
+		writeNoCharacter(w, r, id)
+		return
+	}
+	if err != nil {
+		log.WithError(err).Warn("Failed to query database")
+		writeInternalError(w, r, "Failed to query database")
+		return
+	}
+
+	writeCharacter(w, http.StatusOK, c)
+}
+
+func (dbc DbClient) createCharacterHandler(w http.ResponseWriter, r *http.Request) {
+	log := logrus.WithFields(logrus.Fields{
+		"method": "createCharacter",
+		"ip":     r.RemoteAddr,
+	})
+	log.Debug("Received request to create character")
+
+	c, ok := dbc.readCharacter(w, r, log)
+	if !ok {
+		return
+	}
+	id, err := newCharacterID()
+	if err != nil {
+		log.WithError(err).Warn("Failed to generate character id")
+		writeInternalError(w, r, "Failed to save character")
+		return
+	}
+	c.ID = id
+	c.CreatedAt = time.Now().UTC().Truncate(time.Microsecond)
+	c.UpdatedAt = c.CreatedAt
+
+	data, err := json.Marshal(c)
+	if err != nil {
+		log.WithError(err).Warn("Failed to encode character")
+		writeInternalError(w, r, "Failed to save character")
+		return
+	}
+	_, err = dbc.Exec("INSERT INTO "+CHARACTERS_TABLE+
+		" (id, name, data, created_at, updated_at) VALUES ($1, $2, $3, $4, $5)",
+		c.ID, c.Name, string(data), c.CreatedAt, c.UpdatedAt)
+	if err != nil {
+		log.WithError(err).Warn("Failed to save character")
+		writeInternalError(w, r, "Failed to save character")
+		return
+	}
+
+	log.WithField("id", c.ID).Info("Created character")
+	w.Header().Set("Location", API_PREFIX+"/"+CHARACTERS_TABLE+"/"+c.ID)
+	writeCharacter(w, http.StatusCreated, *c)
+}
+
+// updateCharacterHandler replaces a character, keeping its id and when it
+// was created.
+func (dbc DbClient) updateCharacterHandler(w http.ResponseWriter, r *http.Request) {
+	id, _ := url.PathUnescape(mux.Vars(r)["id"])
+	log := logrus.WithFields(logrus.Fields{
+		"id":     id,
+		"method": "updateCharacter",
+		"ip":     r.RemoteAddr,
+	})
+	log.Debug("Received request to update character")
+
+	c, ok := dbc.readCharacter(w, r, log)
+	if !ok {
+		return
+	}
+	c.ID = id
+	c.UpdatedAt = time.Now().UTC().Truncate(time.Microsecond)
+
+	data, err := json.Marshal(c)
+	if err != nil {
+		log.WithError(err).Warn("Failed to encode character")
+		writeInternalError(w, r, "Failed to save character")
+		return
+	}
+	err = dbc.QueryRow("UPDATE "+CHARACTERS_TABLE+
+		" SET name = $1, data = $2, updated_at = $3 WHERE id = $4 RETURNING created_at",
+		c.Name, string(data), c.UpdatedAt, id).Scan(&c.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		log.Warn("No such character")
+		writeNoCharacter(w, r, id)
+		return
+	}
+	if err != nil {
+		log.WithError(err).Warn("Failed to save character")
+		writeInternalError(w, r, "Failed to save character")
+		return
+	}
+
+	log.Info("Updated character")
+	writeCharacter(w, http.StatusOK, *c)
+}
+
+func (dbc DbClient) deleteCharacterHandler(w http.ResponseWriter, r *http.Request) {
+	id, _ := url.PathUnescape(mux.Vars(r)["id"])
+	log := logrus.WithFields(logrus.Fields{
+		"id":     id,
+		"method": "deleteCharacter",
+		"ip":     r.RemoteAddr,
+	})
+	log.Debug("Received request to delete character")
+
+	res, err := dbc.Exec("DELETE FROM "+CHARACTERS_TABLE+" WHERE id = $1", id)
+	if err != nil {
+		log.WithError(err).Warn("Failed to delete character")
+		writeInternalError(w, r, "Failed to delete character")
+		return
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		log.Warn("No such character")
+		writeNoCharacter(w, r, id)
+		return
+	}
+
+	log.Info("Deleted character")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCharacterNormalize(t *testing.T) {
+	c := Character{
+		Name:          "  Tordek ",
+		Race:          "dwarf",
+		Classes:       []CharacterClass{{Class: "fighter", Level: 15}, {Class: "cleric", Level: 6}},
+		AbilityScores: map[string]int{"str": 16, "cha": 0},
+		Equipment:     []CharacterItem{{Equipment: "battleaxe"}},
+		Spells:        []string{"bless", "bless"},
+	}
+	problems := c.normalize()
+
+	if c.Name != "Tordek" || c.Level != 21 || c.Equipment[0].Quantity != 1 {
+		t.Errorf("Unexpected character %+v", c)
+	}
+	for _, field := range []string{"level", "ability_scores.cha", "spells[1]"} {
+		if problems[field] == "" {
+			t.Errorf("Expected a problem with %s, got %v", field, problems)
+		}
+	}
+	if len(problems) != 3 {
+		t.Errorf("Expected 3 problems, got %v", problems)
+	}
+
+	// The name limit counts characters, not bytes.
+	for n, ok := range map[int]bool{MAX_CHARACTER_NAME: true, MAX_CHARACTER_NAME + 1: false} {
+		c := Character{Name: strings.Repeat("é", n)}
+		if _, long := c.normalize()["name"]; long == ok {
+			t.Errorf("%d character name: expected ok to be %v", n, ok)
+		}
+	}
+}
+
+func TestSqliteCharacters(t *testing.T) {
+	srv := newSqliteTestServer(t)
+
+	do := func(method string, path string, body string, v interface{}) *http.Response {
+		req, _ := http.NewRequest(method, srv.URL+"/v1/characters"+path, bytes.NewBufferString(body))
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		defer res.Body.Close()
+		if v != nil {
+			json.NewDecoder(res.Body).Decode(v)
+		}
+		return res
+	}
+
+	var created Character
+	res := do("POST", "", `{
+		"name": "Tordek",
+		"race": "dwarf",
+		"subrace": "hill-dwarf",
+		"classes": [{"class": "fighter", "level": 3}, {"class": "barbarian", "subclass": "berserker", "level": 2}],
+		"background": "acolyte",
+		"ability_scores": {"str": 16, "dex": 12, "con": 15, "int": 10, "wis": 13, "cha": 8},
+		"equipment": [{"equipment": "battleaxe"}, {"equipment": "bag-of-holding", "quantity": 1}],
+		"spells": ["fireball"]
+	}`, &created)
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d", res.StatusCode)
+	}
+	if created.ID == "" || created.Level != 5 || created.CreatedAt.IsZero() {
+		t.Fatalf("Unexpected character %+v", created)
+	}
+	if loc := res.Header.Get("Location"); loc != "/v1/characters/"+created.ID {
+		t.Errorf("Unexpected Location %q", loc)
+	}
+
+	var got Character
+	if res := do("GET", "/"+created.ID, "", &got); res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", res.StatusCode)
+	}
+	if got.Name != "Tordek" || got.Subrace != "hill-dwarf" || got.AbilityScores["con"] != 15 ||
+		!got.CreatedAt.Equal(created.CreatedAt) {
+		t.Errorf("Expected the saved character, got %+v", got)
+	}
+
+	var updated Character
+	res = do("PUT", "/"+created.ID, `{
+		"name": "Tordek",
+		"race": "dwarf",
+		"classes": [{"class": "fighter", "level": 4}]
+	}`, &updated)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", res.StatusCode)
+	}
+	if updated.ID != created.ID || updated.Level != 4 || !updated.CreatedAt.Equal(created.CreatedAt) ||
+		len(updated.Spells) != 0 {
+		t.Errorf("Unexpected update %+v", updated)
+	}
+
+	var list []Character
+	do("POST", "", `{"name": "Alhandra", "race": "human", "classes": [{"class": "paladin", "level": 1}]}`, nil)
+	do("GET", "", "", &list)
+	if len(list) != 2 || list[0].Name != "Alhandra" || list[1].Level != 4 {
+		t.Errorf("Expected both characters by name, got %+v", list)
+	}
+
+	var invalid ErrorEnvelope
+	res = do("POST", "", `{
+		"name": "Nobody",
+		"race": "elf",
+		"subrace": "hill-dwarf",
+		"classes": [{"class": "wizard", "subclass": "berserker", "level": 1}],
+		"ability_scores": {"luck": 10},
+		"equipment": [{"equipment": "lightsaber"}],
+		"spells": ["not-a-spell"]
+	}`, &invalid)
+	if res.StatusCode != http.StatusBadRequest || invalid.Error.Code != ERR_INVALID_BODY {
+		t.Fatalf("Expected invalid_body, got %d %+v", res.StatusCode, invalid)
+	}
+	fields, _ := invalid.Error.Details["fields"].(map[string]interface{})
+	for _, field := range []string{
+		"subrace", "classes[0].subclass", "ability_scores.luck", "equipment[0].equipment", "spells[0]",
+	} {
+		if fields[field] == nil {
+			t.Errorf("Expected a problem with %s, got %v", field, fields)
+		}
+	}
+	if len(fields) != 5 {
+		t.Errorf("Expected 5 problems, got %v", fields)
+	}
+
+	if res := do("POST", "", `{"name": "Tordek", "hp": 10}`, nil); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected unknown fields to be rejected, got %d", res.StatusCode)
+	}
+
+	if res := do("DELETE", "/"+created.ID, "", nil); res.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected status 204, got %d", res.StatusCode)
+	}
+	for _, method := range []string{"GET", "DELETE"} {
+		var missing ErrorEnvelope
+		if res := do(method, "/"+created.ID, "", &missing); res.StatusCode != http.StatusNotFound ||
+			missing.Error.Code != ERR_NOT_FOUND {
+			t.Errorf("%s: Expected not_found, got %d %+v", method, res.StatusCode, missing)
+		}
+	}
+	if res := do("PUT", "/"+created.ID, `{"name": "Tordek", "race": "dwarf", "classes": [{"class": "fighter", "level": 1}]}`, nil); res.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected updating a deleted character to be not found, got %d", res.StatusCode)
+	}
+}
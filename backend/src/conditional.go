@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DataVersion identifies the imported data as a whole, and the build serving
+// it. Everything the read endpoints return is derived from the two, so it
+// only changes on import or deploy.
+type DataVersion struct {
+	Hash     string
+	Modified time.Time
+}
+
+// buildVersion identifies the running code, since documents such as
+// /openapi.json and /schema change with it rather than with the data.
+var buildVersion = sync.OnceValue(readBuildVersion)
+
+// readBuildVersion uses the commit the binary was built from, or when it
+// wasn't built from a clean checkout, a hash of the binary itself.
+func readBuildVersion() DataVersion {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		settings := make(map[string]string)
+		for _, s := range info.Settings {
+			settings[s.Key] = s.Value
+		}
+		if rev := settings["vcs.revision"]; rev != "" && settings["vcs.modified"] != "true" {
+			modified, _ := time.Parse(time.RFC3339, settings["vcs.time"])
+			return DataVersion{rev, modified}
+		}
+	}
+
+	if exe, err := os.Executable(); err == nil {
+		if f, err := os.Open(exe); err == nil {
+			defer f.Close()
+			h := sha256.New()
+			stat, err := f.Stat()
+			if _, copyErr := io.Copy(h, f); copyErr == nil && err == nil {
+				return DataVersion{hex.EncodeToString(h.Sum(nil)), stat.ModTime()}
+			}
+		}
+	}
+
+	logrus.Warn("Failed to identify the build, validators will change on restart")
+	now := time.Now()
+	return DataVersion{fmt.Sprint(now.UnixNano()), now}
+}
+
+var (
+	dataVersionMu sync.Mutex
+	dataVersion   *DataVersion
+)
+
+func forgetDataVersion() {
+	dataVersionMu.Lock()
+	defer dataVersionMu.Unlock()
+	dataVersion = nil
+}
+
+func currentDataVersion(db *sql.DB) (*DataVersion, error) {
+	dataVersionMu.Lock()
+	defer dataVersionMu.Unlock()
+	if dataVersion != nil {
+		return dataVersion, nil
+	}
+
+	versions, err := getDatasetVersions(db)
+	if err != nil {
+		return nil, err
+	}
+	tables := make([]string, 0, len(versions))
+	for table := range versions {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+
+	build := buildVersion()
+	v := DataVersion{Modified: build.Modified}
+	h := sha256.New()
+	fmt.Fprintf(h, "build %s\n", build.Hash)
+	for _, table := range tables {
+		tv := versions[table]
+		fmt.Fprintf(h, "%s %s %d %d\n", table, tv.Hash, tv.SchemaVersion, tv.ImportedAt.UnixNano())
+		if tv.ImportedAt.After(v.Modified) {
+			v.Modified = tv.ImportedAt
+		}
+	}
+	v.Hash = hex.EncodeToString(h.Sum(nil))
+	// HTTP dates have whole seconds.
+	v.Modified = v.Modified.UTC().Truncate(time.Second)
+
+	dataVersion = &v
+	return dataVersion, nil
+}
+
+// etag is weak because compression changes the bytes but not the content.
+// It covers the URL and Accept header, which pick what is returned.
+func (v *DataVersion) etag(r *http.Request) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%s\n", v.Hash, r.URL.RequestURI(), r.Header.Get("Accept"))
+	return `W/"` + hex.EncodeToString(h.Sum(nil))[:32] + `"`
+}
+
+func etagMatches(header string, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified applies If-None-Match, or If-Modified-Since when there is no
+// If-None-Match, as RFC 9110 orders them.
+func notModified(r *http.Request, etag string, modified time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		return etagMatches(inm, etag)
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+		since, err := http.ParseTime(ims)
+		return err == nil && !modified.After(since)
+	}
+	return false
+}
+
+// validatedWriter drops the validators from anything but a 200, so errors
+// are never cached as if they were the data.
+type validatedWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (vw *validatedWriter) WriteHeader(code int) {
+	if !vw.wroteHeader && code != http.StatusOK {
+		vw.Header().Del("ETag")
+		vw.Header().Del("Last-Modified")
+		vw.Header().Del("Cache-Control")
+	}
+	vw.wroteHeader = true
+	vw.ResponseWriter.WriteHeader(code)
+}
+
+func (vw *validatedWriter) Write(b []byte) (int, error) {
+	if !vw.wroteHeader {
+		vw.WriteHeader(http.StatusOK)
+	}
+	return vw.ResponseWriter.Write(b)
+}
+
+// conditional adds an ETag and Last-Modified tied to the last import and
+// deploy to a read endpoint, answering conditional requests that still match with 304.
+func (dbc DbClient) conditional(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			next(w, r)
+			return
+		}
+
+		v, err := currentDataVersion(dbc.DB)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"method": "conditional",
+				"ip":     r.RemoteAddr,
+			}).WithError(err).Warn("Failed to get data version")
+			next(w, r)
+			return
+		}
+
+		etag := v.etag(r)
+		h := w.Header()
+		h.Set("ETag", etag)
+		h.Set("Last-Modified", v.Modified.Format(http.TimeFormat))
+		// Caches may keep responses but must check back, which is cheap.
+		h.Set("Cache-Control", "public, no-cache")
+		addVary(h, "Accept")
+
+		if notModified(r, etag, v.Modified) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		next(&validatedWriter{ResponseWriter: w}, r)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestAcceptedEncoding(t *testing.T) {
+	tests := map[string]string{
+		"":                        "",
+		"identity":                "",
+		"gzip, deflate":           "gzip",
+		"gzip, deflate, br, zstd": "br",
+		"br;q=0.5, gzip":          "gzip",
+		"*":                       "br",
+		"*, br;q=0":               "gzip",
+	}
+	for header, want := range tests {
+		if got := acceptedEncoding(header); got != want {
+			t.Errorf("%q: expected %q, got %q", header, want, got)
+		}
+	}
+}
+
+func TestSqliteConditional(t *testing.T) {
+	srv := newSqliteTestServer(t)
+
+	get := func(path string, headers map[string]string) *http.Response {
+		req, _ := http.NewRequest("GET", srv.URL+path, nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		res, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		t.Cleanup(func() { res.Body.Close() })
+		return res
+	}
+
+	res := get("/all/spells", map[string]string{"Accept-Encoding": "gzip"})
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Expected a gzipped 200, got %d %q", res.StatusCode, res.Header.Get("Content-Encoding"))
+	}
+	gz, err := gzip.NewReader(res.Body)
+	if err != nil {
+		t.Fatalf("Failed to read gzip: %v", err)
+	}
+	var spells []map[string]interface{}
+	if err := json.NewDecoder(gz).Decode(&spells); err != nil || len(spells) != 319 {
+		t.Errorf("Expected 319 spells, got %d (%v)", len(spells), err)
+	}
+
+	etag := res.Header.Get("ETag")
+	modified := res.Header.Get("Last-Modified")
+	if etag == "" || modified == "" {
+		t.Fatalf("Expected ETag and Last-Modified, got %q and %q", etag, modified)
+	}
+
+	res = get("/all/spells", map[string]string{"Accept-Encoding": "br"})
+	if res.Header.Get("Content-Encoding") != "br" || res.Header.Get("ETag") != etag {
+		t.Errorf("Expected a brotli response with the same ETag, got %q %q",
+			res.Header.Get("Content-Encoding"), res.Header.Get("ETag"))
+	}
+	body, err := io.ReadAll(brotli.NewReader(res.Body))
+	if err != nil || !json.Valid(body) {
+		t.Errorf("Failed to read brotli response: %v", err)
+	}
+
+	if res := get("/all/spells", map[string]string{"If-None-Match": etag}); res.StatusCode != http.StatusNotModified {
+		t.Errorf("Expected 304 for a matching ETag, got %d", res.StatusCode)
+	}
+	if res := get("/all/spells", map[string]string{"If-Modified-Since": modified}); res.StatusCode != http.StatusNotModified {
+		t.Errorf("Expected 304 for If-Modified-Since, got %d", res.StatusCode)
+	}
+	if res := get("/all/spells?limit=5", map[string]string{"If-None-Match": etag}); res.StatusCode != http.StatusOK {
+		t.Errorf("Expected 200 for a different URL, got %d", res.StatusCode)
+	}
+
+	res = get("/v1/spells/not-a-spell", nil)
+	if res.StatusCode != http.StatusNotFound || res.Header.Get("ETag") != "" {
+		t.Errorf("Expected a 404 without an ETag, got %d %q", res.StatusCode, res.Header.Get("ETag"))
+	}
+}
+
+func TestSqliteConditionalDeploy(t *testing.T) {
+	srv := newSqliteTestServer(t)
+
+	get := func(headers map[string]string) *http.Response {
+		req, _ := http.NewRequest("GET", srv.URL+"/v1/openapi.json", nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	res := get(nil)
+	etag, modified := res.Header.Get("ETag"), res.Header.Get("Last-Modified")
+	if res := get(map[string]string{"If-None-Match": etag}); res.StatusCode != http.StatusNotModified {
+		t.Fatalf("Expected 304 before a deploy, got %d", res.StatusCode)
+	}
+
+	// A new build, as after a deploy that changes how the document is made.
+	previous := buildVersion
+	buildVersion = func() DataVersion {
+		return DataVersion{"next-build", time.Now().Add(time.Hour)}
+	}
+	forgetDataVersion()
+	defer func() {
+		buildVersion = previous
+		forgetDataVersion()
+	}()
+
+	for _, headers := range []map[string]string{
+		{"If-None-Match": etag},
+		{"If-Modified-Since": modified},
+	} {
+		if res := get(headers); res.StatusCode != http.StatusOK || res.Header.Get("ETag") == etag {
+			t.Errorf("%v: Expected a 200 with a new ETag after a deploy, got %d %s",
+				headers, res.StatusCode, res.Header.Get("ETag"))
+		}
+	}
+}
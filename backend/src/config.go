@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// Config says where the server listens and how it reaches its database. Each
+// setting can be given as a flag, falling back to the environment variable
+// named in its help text.
+type Config struct {
+	Addr   string
+	Driver string
+
+	// Where the gRPC API listens, empty to not serve it.
+	GrpcAddr string
+
+	// Megabytes of query results to keep in memory, 0 to always read
+	// from the database.
+	CacheMB int
+
+	// SQLite
+	Path string
+
+	// Postgres. A DSN is used as-is; otherwise one is built from the
+	// endpoint and credentials from the first secret source that is set.
+	DSN        string
+	Endpoint   string
+	Port       string
+	SSLMode    string
+	Username   string
+	Password   string
+	SecretFile string
+	SecretName string
+}
+
+func envOr(key string, fallback string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+	return fallback
+}
+
+func envIntOr(key string, fallback int) int {
+	if v, ok := os.LookupEnv(key); ok {
+		if i, err := strconv.Atoi(v); err == nil {
+			return i
+		}
+		log.Warnf("Ignoring %s=%s, not a number", key, v)
+	}
+	return fallback
+}
+
+func loadConfig(args []string) (*Config, error) {
+	var conf Config
+	fs := flag.NewFlagSet("rpg-app", flag.ContinueOnError)
+	fs.StringVar(&conf.Addr, "addr", envOr("LISTEN_ADDR", ":80"),
+		"address to listen on (LISTEN_ADDR)")
+	fs.StringVar(&conf.GrpcAddr, "grpc-addr", envOr("GRPC_LISTEN_ADDR", ""),
+		"address for the gRPC API to listen on, e.g. :9090, empty disables it (GRPC_LISTEN_ADDR)")
+	fs.StringVar(&conf.Driver, "driver", envOr("DB_DRIVER", "postgres"),
+		"database driver, postgres or sqlite (DB_DRIVER)")
+	fs.IntVar(&conf.CacheMB, "cache-mb", envIntOr("CACHE_MB", 0),
+		"megabytes of query results to cache in memory, 0 disables (CACHE_MB)")
+	fs.StringVar(&conf.Path, "db-path", envOr("DB_PATH", DND_DATABASE+".db"),
+		"sqlite database file (DB_PATH)")
+	fs.StringVar(&conf.DSN, "dsn", envOr("DB_DSN", ""),
+		"postgres connection string, used as-is (DB_DSN)")
+	fs.StringVar(&conf.Endpoint, "db-endpoint", envOr("DB_ENDPOINT", "localhost"),
+		"postgres host (DB_ENDPOINT)")
+	fs.StringVar(&conf.Port, "db-port", envOr("DB_PORT", "5432"),
+		"postgres port (DB_PORT)")
+	fs.StringVar(&conf.SSLMode, "db-sslmode", envOr("DB_SSLMODE", "require"),
+		"postgres sslmode (DB_SSLMODE)")
+	fs.StringVar(&conf.Username, "db-user", envOr("DB_USER", ""),
+		"postgres username (DB_USER)")
+	fs.StringVar(&conf.Password, "db-password", envOr("DB_PASSWORD", ""),
+		"postgres password (DB_PASSWORD)")
+	fs.StringVar(&conf.SecretFile, "secret-file", envOr("DB_SECRET_FILE", ""),
+		"JSON file with postgres username and password (DB_SECRET_FILE)")
+	fs.StringVar(&conf.SecretName, "secret-name", envOr("DB_SECRET", ""),
+		"AWS Secrets Manager secret with postgres credentials (DB_SECRET)")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if conf.CacheMB < 0 {
+		return nil, errors.New("cache size can't be negative")
+	}
+
+	switch conf.Driver {
+	case "postgres", "sqlite":
+	case "sqlite3":
+		conf.Driver = "sqlite"
+	default:
+		return nil, errors.New("unknown database driver " + conf.Driver)
+	}
+
+	return &conf, nil
+}
+
+// SecretSource supplies the username and password for Postgres.
+type SecretSource interface {
+	Name() string
+	GetSecret(ctx context.Context) (*RdsSecret, error)
+}
+
+type staticSecret struct {
+	secret RdsSecret
+}
+
+func (s staticSecret) Name() string {
+	return "env"
+}
+
+func (s staticSecret) GetSecret(ctx context.Context) (*RdsSecret, error) {
+	return &s.secret, nil
+}
+
+// fileSecret reads a file shaped like the RDS secret:
+// {"username": "...", "password": "..."}
+type fileSecret struct {
+	path string
+}
+
+func (s fileSecret) Name() string {
+	return "file"
+}
+
+func (s fileSecret) GetSecret(ctx context.Context) (*RdsSecret, error) {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		log.Warnf("failed to read secret file, %v", err)
+		return nil, err
+	}
+
+	var secret RdsSecret
+	if err := json.Unmarshal(data, &secret); err != nil {
+		log.Warnf("failed to unmarshal secret file, %v", err)
+		return nil, err
+	}
+
+	return &secret, nil
+}
+
+// awsSecret only loads the AWS config when the secret is first fetched, so
+// nothing touches AWS unless this source is selected.
+type awsSecret struct {
+	name string
+}
+
+func (s awsSecret) Name() string {
+	return "aws"
+}
+
+func (s awsSecret) GetSecret(ctx context.Context) (*RdsSecret, error) {
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		log.Warnf("failed to load AWS config, %v", err)
+		return nil, err
+	}
+	log.Info("AWS config loaded")
+
+	return getSecret(ctx, cfg, s.name)
+}
+
+// secretSource picks where Postgres credentials come from, preferring the
+// most local option that has been configured.
+func (conf *Config) secretSource() (SecretSource, error) {
+	switch {
+	case conf.Username != "":
+		return staticSecret{RdsSecret{conf.Username, conf.Password}}, nil
+	case conf.SecretFile != "":
+		return fileSecret{conf.SecretFile}, nil
+	case conf.SecretName != "":
+		return awsSecret{conf.SecretName}, nil
+	default:
+		return nil, errors.New("no database credentials configured: set a DSN, " +
+			"DB_USER, DB_SECRET_FILE or DB_SECRET")
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSecretSource(t *testing.T) {
+	for _, key := range []string{"DB_DRIVER", "DB_DSN", "DB_USER", "DB_PASSWORD", "DB_SECRET_FILE", "DB_SECRET", "GRPC_LISTEN_ADDR"} {
+		t.Setenv(key, "")
+		os.Unsetenv(key)
+	}
+
+	secretFile := filepath.Join(t.TempDir(), "secret.json")
+	if err := os.WriteFile(secretFile, []byte(`{"username": "dm", "password": "d20"}`), 0600); err != nil {
+		t.Fatalf("Failed to write secret file: %v", err)
+	}
+
+	cases := []struct {
+		args   []string
+		source string
+	}{
+		{[]string{"-db-user", "dm", "-db-password", "d20", "-secret-name", "rds"}, "env"},
+		{[]string{"-secret-file", secretFile, "-secret-name", "rds"}, "file"},
+		{[]string{"-secret-name", "rds"}, "aws"},
+	}
+
+	for _, c := range cases {
+		conf, err := loadConfig(c.args)
+		if err != nil {
+			t.Fatalf("Failed to load config %v: %v", c.args, err)
+		}
+		secrets, err := conf.secretSource()
+		if err != nil {
+			t.Fatalf("Failed to pick secret source for %v: %v", c.args, err)
+		}
+		if secrets.Name() != c.source {
+			t.Errorf("Expected %s secret source for %v, got %s", c.source, c.args, secrets.Name())
+		}
+		if c.source == "aws" {
+			continue
+		}
+
+		secret, err := secrets.GetSecret(context.Background())
+		if err != nil {
+			t.Fatalf("Failed to get secret: %v", err)
+		}
+		if secret.Username != "dm" || secret.Password != "d20" {
+			t.Errorf("Unexpected secret %v", secret)
+		}
+	}
+
+	conf, err := loadConfig(nil)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if _, err := conf.secretSource(); err == nil {
+		t.Errorf("Expected an error with no credentials configured")
+	}
+	if conf.GrpcAddr != "" {
+		t.Errorf("Expected gRPC to be off by default, got %q", conf.GrpcAddr)
+	}
+
+	if _, err := loadConfig([]string{"-driver", "mysql"}); err == nil {
+		t.Errorf("Expected an error for an unknown driver")
+	}
+}
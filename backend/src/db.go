@@ -6,7 +6,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/url"
-	"os"
 
 	_ "github.com/lib/pq"
 	"github.com/sirupsen/logrus"
@@ -46,8 +45,8 @@ func getSecret(ctx context.Context, cfg aws.Config, secretName string) (*RdsSecr
 	return &secret, nil
 }
 
-func getEndpoint() string {
-	return fmt.Sprintf("%s:%s", os.Getenv("DB_ENDPOINT"), os.Getenv("DB_PORT"))
+func (conf *Config) endpoint() string {
+	return fmt.Sprintf("%s:%s", conf.Endpoint, conf.Port)
 }
 
 func createDatabase(db *sql.DB, databaseName string) error {
@@ -69,31 +68,46 @@ func createDatabase(db *sql.DB, databaseName string) error {
 	return nil
 }
 
-func connectToDb(ctx context.Context, cfg aws.Config, secretName string, databaseName string) (*sql.DB, error) {
-	secret, err := getSecret(ctx, cfg, secretName)
+func openPostgres(dsn string) (*sql.DB, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		log.WithError(err).Error("Failed to connect to db")
+		return nil, err
+	}
+	if err = db.Ping(); err != nil {
+		log.WithError(err).Error("Failed to ping db")
+		db.Close()
+		return nil, err
+	}
+	logrus.Info("Successfully connected to db")
+
+	return db, nil
+}
+
+func connectToDb(ctx context.Context, conf *Config, secrets SecretSource, databaseName string) (*sql.DB, error) {
+	secret, err := secrets.GetSecret(ctx)
 	if err != nil {
 		log.Warnf("failed to get secret, %v", err)
 		return nil, err
 	}
-	logrus.Info("Successfully retrieved secret")
-	logrus.Debugf("Password: %s Username: %s", secret.Password, secret.Username)
+	logrus.WithField("source", secrets.Name()).Info("Successfully retrieved secret")
+	logrus.Debugf("Username: %s", secret.Username)
 
-	endpoint := getEndpoint()
+	endpoint := conf.endpoint()
 	logrus.Debugf("Endpoint: %s", endpoint)
 
 	var dsn string
 	if databaseName != "" {
-		dsn = fmt.Sprintf("postgres://%s:%s@%s/%s?sslmode=require",
+		dsn = fmt.Sprintf("postgres://%s:%s@%s/%s?sslmode=%s",
 			url.QueryEscape(secret.Username),
 			url.QueryEscape(secret.Password),
-			endpoint, databaseName)
+			endpoint, databaseName, conf.SSLMode)
 	} else {
-		dsn = fmt.Sprintf("postgres://%s:%s@%s?sslmode=require",
+		dsn = fmt.Sprintf("postgres://%s:%s@%s?sslmode=%s",
 			url.QueryEscape(secret.Username),
 			url.QueryEscape(secret.Password),
-			endpoint)
+			endpoint, conf.SSLMode)
 	}
-	logrus.Debugf("DSN: %s", dsn)
 
 	db, err := sql.Open("postgres", dsn)
 	if err != nil {
@@ -101,19 +115,23 @@ func connectToDb(ctx context.Context, cfg aws.Config, secretName string, databas
 		return nil, err
 	}
 	if err = db.Ping(); err != nil {
+		// This handle can't be used, and a new one is opened once the
+		// database exists.
+		db.Close()
 		does_not_exist_err := fmt.Sprintf("pq: database \"%s\" does not exist", databaseName)
 		if err.Error() == does_not_exist_err {
 			logrus.Infof("Database does not exist, creating database %s", databaseName)
-			dbClient, err := connectToDb(ctx, cfg, secretName, "postgres")
+			dbClient, err := connectToDb(ctx, conf, secrets, "postgres")
 			if err != nil {
 				logrus.Errorf("failed to connect to postgres via default \"database\" postgres, %v", err)
 				return nil, err
 			}
+			defer dbClient.Close()
 			if err = createDatabase(dbClient, databaseName); err != nil {
 				logrus.Errorf("failed to create database, %v", err)
 				return nil, err
 			}
-			connectToDb(ctx, cfg, secretName, databaseName)
+			return connectToDb(ctx, conf, secrets, databaseName)
 		} else {
 			log.WithError(err).Error("Failed to ping db")
 			return nil, err
@@ -0,0 +1,476 @@
+// Package dice parses and rolls dice notation such as "18d10+36", "4d6kh3"
+// or "d20adv+5".
+//
+// An expression is a sum of terms. A term is a whole number or NdS, N dice
+// of S sides (N defaults to 1, and d% is d100), followed by any of:
+//
+//	khN, klN  keep the N highest or lowest dice (N defaults to 1); k is kh
+//	dhN, dlN  drop the N highest or lowest dice
+//	adv, dis  roll a single die twice and keep the higher or lower
+//	rC        reroll dice matching C until they don't
+//	roC       reroll dice matching C once
+//	!, !C     roll another die for each die that is the highest face, or
+//	          that matches C
+//
+// A condition C is a number, or <N or >N for N or less and N or more.
+package dice
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	MAX_EXPR_LEN   = 200
+	MAX_TERMS      = 50
+	MAX_DICE       = 1000
+	MAX_SIDES      = 1000
+	MAX_REROLLS    = 100
+	MAX_EXPLOSIONS = 100
+)
+
+// SyntaxError is a problem with an expression at a byte offset into it.
+type SyntaxError struct {
+	Pos int
+	Msg string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("%s at position %d", e.Msg, e.Pos+1)
+}
+
+// Compare is a condition on a die's value.
+type Compare struct {
+	Op    byte // '=', '<' or '>'
+	Value int
+}
+
+func (c Compare) Match(v int) bool {
+	switch c.Op {
+	case '<':
+		return v <= c.Value
+	case '>':
+		return v >= c.Value
+	default:
+		return v == c.Value
+	}
+}
+
+// Term is one part of the sum, a number when Sides is 0.
+type Term struct {
+	Text  string
+	Sign  int
+	Value int
+
+	Count int
+	Sides int
+	// Keep the KeepHigh highest or KeepLow lowest dice, when set.
+	KeepHigh int
+	KeepLow  int
+	// Drop the DropHigh highest and DropLow lowest dice.
+	DropHigh     int
+	DropLow      int
+	Reroll       []Compare
+	RerollOnce   []Compare
+	Explode      *Compare
+	Advantage    bool
+	Disadvantage bool
+}
+
+// Expr is a parsed expression, which can be rolled any number of times.
+type Expr struct {
+	Text  string
+	Terms []Term
+}
+
+type parser struct {
+	s   string
+	pos int
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return &SyntaxError{p.pos, fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) skipSpace() {
+	for p.pos < len(p.s) && (p.s[p.pos] == ' ' || p.s[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+func (p *parser) peek() byte {
+	if p.pos < len(p.s) {
+		return p.s[p.pos]
+	}
+	return 0
+}
+
+// consume skips over prefix, ignoring case, if the input continues with it.
+func (p *parser) consume(prefix string) bool {
+	if len(p.s)-p.pos >= len(prefix) && strings.EqualFold(p.s[p.pos:p.pos+len(prefix)], prefix) {
+		p.pos += len(prefix)
+		return true
+	}
+	return false
+}
+
+// number reads a whole number, or returns ok false if there isn't one.
+func (p *parser) number() (int, bool, error) {
+	start := p.pos
+	for p.pos < len(p.s) && p.s[p.pos] >= '0' && p.s[p.pos] <= '9' {
+		p.pos++
+	}
+	if p.pos == start {
+		return 0, false, nil
+	}
+	n, err := strconv.Atoi(p.s[start:p.pos])
+	if err != nil || n > 1_000_000 {
+		p.pos = start
+		return 0, false, p.errorf("number too large")
+	}
+	return n, true, nil
+}
+
+func (p *parser) optionalNumber(fallback int) (int, error) {
+	n, ok, err := p.number()
+	if err != nil || !ok {
+		return fallback, err
+	}
+	return n, nil
+}
+
+// keepCount reads how many dice a keep or drop applies to, 1 by default.
+func (p *parser) keepCount() (int, error) {
+	start := p.pos
+	n, err := p.optionalNumber(1)
+	if err == nil && n < 1 {
+		p.pos = start
+		return 0, p.errorf("keep or drop count must be at least 1")
+	}
+	return n, err
+}
+
+func (p *parser) compare(required bool) (*Compare, error) {
+	c := Compare{Op: '='}
+	switch p.peek() {
+	case '<', '>', '=':
+		c.Op = p.peek()
+		p.pos++
+		required = true
+	}
+	n, ok, err := p.number()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		if required {
+			return nil, p.errorf("expected a number")
+		}
+		return nil, nil
+	}
+	c.Value = n
+	return &c, nil
+}
+
+// Parse reads an expression, checking that it can be rolled within the
+// limits on dice, sides, rerolls and explosions.
+func Parse(s string) (*Expr, error) {
+	if len(s) > MAX_EXPR_LEN {
+		return nil, &SyntaxError{MAX_EXPR_LEN, fmt.Sprintf("expression longer than %d characters", MAX_EXPR_LEN)}
+	}
+	p := &parser{s: s}
+	expr := &Expr{Text: strings.TrimSpace(s)}
+
+	for {
+		p.skipSpace()
+		sign := 1
+		if len(expr.Terms) > 0 || p.peek() == '-' || p.peek() == '+' {
+			switch p.peek() {
+			case '+':
+			case '-':
+				sign = -1
+			case 0:
+				if len(expr.Terms) == 0 {
+					return nil, p.errorf("empty expression")
+				}
+				return expr, nil
+			default:
+				return nil, p.errorf("expected + or -")
+			}
+			p.pos++
+			p.skipSpace()
+		}
+		if p.peek() == 0 {
+			return nil, p.errorf("expected a number or dice")
+		}
+
+		start := p.pos
+		term, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		term.Sign = sign
+		term.Text = p.s[start:p.pos]
+		if len(expr.Terms) == MAX_TERMS {
+			return nil, &SyntaxError{start, fmt.Sprintf("more than %d terms", MAX_TERMS)}
+		}
+		expr.Terms = append(expr.Terms, term)
+	}
+}
+
+func (p *parser) term() (Term, error) {
+	start := p.pos
+	count, hasCount, err := p.number()
+	if err != nil {
+		return Term{}, err
+	}
+	if !p.consume("d") {
+		if !hasCount {
+			return Term{}, p.errorf("expected a number or dice")
+		}
+		return Term{Value: count}, nil
+	}
+
+	t := Term{Count: 1}
+	if hasCount {
+		t.Count = count
+	}
+	if p.consume("%") {
+		t.Sides = 100
+	} else if t.Sides, _, err = p.number(); err != nil {
+		return Term{}, err
+	}
+	if t.Count < 1 || t.Count > MAX_DICE {
+		return Term{}, &SyntaxError{start, fmt.Sprintf("number of dice must be between 1 and %d", MAX_DICE)}
+	}
+	if t.Sides < 1 || t.Sides > MAX_SIDES {
+		return Term{}, p.errorf("sides must be between 1 and %d", MAX_SIDES)
+	}
+
+	for {
+		modStart := p.pos
+		switch {
+		case p.consume("adv"):
+			t.Advantage = true
+		case p.consume("dis"):
+			t.Disadvantage = true
+		case p.consume("kl"):
+			t.KeepLow, err = p.keepCount()
+		case p.consume("kh"), p.consume("k"):
+			t.KeepHigh, err = p.keepCount()
+		case p.consume("dh"):
+			t.DropHigh, err = p.keepCount()
+		case p.consume("dl"):
+			t.DropLow, err = p.keepCount()
+		case p.consume("ro"):
+			var c *Compare
+			if c, err = p.compare(true); err == nil {
+				t.RerollOnce = append(t.RerollOnce, *c)
+			}
+		case p.consume("r"):
+			var c *Compare
+			if c, err = p.compare(true); err == nil {
+				t.Reroll = append(t.Reroll, *c)
+			}
+		case p.consume("!"):
+			if t.Explode, err = p.compare(false); err == nil && t.Explode == nil {
+				t.Explode = &Compare{'=', t.Sides}
+			}
+		default:
+			return t, t.check(p.s[start:p.pos], start)
+		}
+		if err != nil {
+			return Term{}, err
+		}
+		if p.pos == modStart {
+			return Term{}, p.errorf("unexpected %q", p.peek())
+		}
+	}
+}
+
+// check rejects dice that can't be rolled, such as rerolling every face.
+func (t *Term) check(text string, pos int) error {
+	fail := func(msg string) error {
+		return &SyntaxError{pos, fmt.Sprintf("%s in %s", msg, text)}
+	}
+
+	keeps := 0
+	for _, n := range []int{t.KeepHigh, t.KeepLow, t.DropHigh + t.DropLow} {
+		if n > 0 {
+			keeps++
+		}
+	}
+	if t.Advantage || t.Disadvantage {
+		if t.Advantage && t.Disadvantage {
+			return fail("advantage and disadvantage cancel out")
+		}
+		if t.Count != 1 || keeps > 0 {
+			return fail("advantage and disadvantage are for a single die without keep or drop")
+		}
+	}
+	if keeps > 1 {
+		return fail("only one of keep or drop can be used")
+	}
+
+	rerollsAll, explodesAll := true, true
+	for v := 1; v <= t.Sides; v++ {
+		if !matchAny(t.Reroll, v) {
+			rerollsAll = false
+		}
+		if t.Explode == nil || !t.Explode.Match(v) {
+			explodesAll = false
+		}
+	}
+	if len(t.Reroll) > 0 && rerollsAll {
+		return fail("rerolls every result")
+	}
+	if explodesAll {
+		return fail("explodes on every result")
+	}
+	return nil
+}
+
+func matchAny(conditions []Compare, v int) bool {
+	for _, c := range conditions {
+		if c.Match(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// Die is one die rolled. Rerolled dice were replaced by the next die and
+// dropped dice were left out by keep or drop; neither counts to the total.
+type Die struct {
+	Value    int  `json:"value"`
+	Dropped  bool `json:"dropped,omitempty"`
+	Rerolled bool `json:"rerolled,omitempty"`
+	Exploded bool `json:"exploded,omitempty"`
+}
+
+type TermResult struct {
+	Expr  string `json:"expr"`
+	Sign  int    `json:"sign"`
+	Dice  []Die  `json:"dice,omitempty"`
+	Total int    `json:"total"`
+}
+
+type Result struct {
+	Expr  string       `json:"expr"`
+	Seed  uint64       `json:"seed"`
+	Terms []TermResult `json:"terms"`
+	Total int          `json:"total"`
+}
+
+func (t *Term) rollDie(rng *rand.Rand) int {
+	return rng.IntN(t.Sides) + 1
+}
+
+// rollOne rolls a die and any rerolls it needs, appending all of them.
+func (t *Term) rollOne(rng *rand.Rand, dice []Die) []Die {
+	v := t.rollDie(rng)
+	if matchAny(t.RerollOnce, v) {
+		dice = append(dice, Die{Value: v, Rerolled: true})
+		v = t.rollDie(rng)
+	}
+	for i := 0; i < MAX_REROLLS && matchAny(t.Reroll, v); i++ {
+		dice = append(dice, Die{Value: v, Rerolled: true})
+		v = t.rollDie(rng)
+	}
+	return append(dice, Die{Value: v})
+}
+
+func (t *Term) roll(rng *rand.Rand) TermResult {
+	res := TermResult{Expr: t.Text, Sign: t.Sign}
+	if t.Sides == 0 {
+		res.Total = t.Value
+		return res
+	}
+
+	count := t.Count
+	keepHigh, keepLow := t.KeepHigh, t.KeepLow
+	switch {
+	case t.Advantage:
+		count, keepHigh = 2, 1
+	case t.Disadvantage:
+		count, keepLow = 2, 1
+	}
+
+	var dice []Die
+	explosions := 0
+	for i := 0; i < count; i++ {
+		dice = t.rollOne(rng, dice)
+		for t.Explode != nil && explosions < MAX_EXPLOSIONS && t.Explode.Match(dice[len(dice)-1].Value) {
+			dice[len(dice)-1].Exploded = true
+			explosions++
+			dice = t.rollOne(rng, dice)
+		}
+	}
+
+	// The dice that count, lowest first, ties in the order rolled.
+	var counted []int
+	for i, d := range dice {
+		if !d.Rerolled {
+			counted = append(counted, i)
+		}
+	}
+	sort.SliceStable(counted, func(a, b int) bool {
+		return dice[counted[a]].Value < dice[counted[b]].Value
+	})
+
+	dropLow, dropHigh := t.DropLow, t.DropHigh
+	if keepHigh > 0 {
+		dropLow, dropHigh = len(counted)-keepHigh, 0
+	}
+	if keepLow > 0 {
+		dropLow, dropHigh = 0, len(counted)-keepLow
+	}
+	for i, idx := range counted {
+		if i < dropLow || i >= len(counted)-dropHigh {
+			dice[idx].Dropped = true
+		} else {
+			res.Total += dice[idx].Value
+		}
+	}
+
+	res.Dice = dice
+	return res
+}
+
+// Roll rolls every term with rng.
+func (e *Expr) Roll(rng *rand.Rand) Result {
+	res := Result{Expr: e.Text}
+	for i := range e.Terms {
+		term := e.Terms[i].roll(rng)
+		res.Total += term.Sign * term.Total
+		res.Terms = append(res.Terms, term)
+	}
+	return res
+}
+
+// RollSeed rolls with a generator seeded with seed, so the same expression
+// and seed always give the same dice.
+func (e *Expr) RollSeed(seed uint64) Result {
+	res := e.Roll(rand.New(rand.NewPCG(seed, seed)))
+	res.Seed = seed
+	return res
+}
+
+// NewSeed picks a random seed. Seeds are below 2^53 so that JavaScript
+// clients can pass them back without losing precision.
+func NewSeed() uint64 {
+	return rand.Uint64N(1 << 53)
+}
+
+// Roll parses and rolls an expression with a random seed, which the result
+// records so the roll can be repeated.
+func Roll(s string) (Result, error) {
+	expr, err := Parse(s)
+	if err != nil {
+		return Result{}, err
+	}
+	return expr.RollSeed(NewSeed()), nil
+}
@@ -0,0 +1,170 @@
+package dice
+
+import (
+	"errors"
+	"math/rand/v2"
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		expr  string
+		terms []Term
+	}{
+		{"18d10+36", []Term{
+			{Text: "18d10", Sign: 1, Count: 18, Sides: 10},
+			{Text: "36", Sign: 1, Value: 36},
+		}},
+		{"-d%", []Term{{Text: "d%", Sign: -1, Count: 1, Sides: 100}}},
+		{"4d6kh3 - 2", []Term{
+			{Text: "4d6kh3", Sign: 1, Count: 4, Sides: 6, KeepHigh: 3},
+			{Text: "2", Sign: -1, Value: 2},
+		}},
+		{"2d20KL", []Term{{Text: "2d20KL", Sign: 1, Count: 2, Sides: 20, KeepLow: 1}}},
+		{"4d6dl", []Term{{Text: "4d6dl", Sign: 1, Count: 4, Sides: 6, DropLow: 1}}},
+		{"d20adv", []Term{{Text: "d20adv", Sign: 1, Count: 1, Sides: 20, Advantage: true}}},
+		{"2d6r<2ro3", []Term{{
+			Text: "2d6r<2ro3", Sign: 1, Count: 2, Sides: 6,
+			Reroll:     []Compare{{'<', 2}},
+			RerollOnce: []Compare{{'=', 3}},
+		}}},
+		{"3d6!", []Term{{Text: "3d6!", Sign: 1, Count: 3, Sides: 6, Explode: &Compare{'=', 6}}}},
+		{"3d10!>9+1", []Term{
+			{Text: "3d10!>9", Sign: 1, Count: 3, Sides: 10, Explode: &Compare{'>', 9}},
+			{Text: "1", Sign: 1, Value: 1},
+		}},
+	}
+
+	for _, c := range cases {
+		expr, err := Parse(c.expr)
+		if err != nil {
+			t.Errorf("%s: Unexpected error %v", c.expr, err)
+			continue
+		}
+		if !reflect.DeepEqual(expr.Terms, c.terms) {
+			t.Errorf("%s: Expected %+v, got %+v", c.expr, c.terms, expr.Terms)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"d",
+		"2d",
+		"0d6",
+		"1001d6",
+		"1d1001",
+		"1d6+",
+		"1d6 2",
+		"1d6x",
+		"1d6r",
+		"2d20adv",
+		"d20advdis",
+		"4d6kh3kl1",
+		"4d6kh0",
+		"2d20kl0",
+		"4d6dh0",
+		"4d6dl0",
+		"1d6r<6",
+		"1d1!",
+		"1d6!<6",
+	} {
+		_, err := Parse(expr)
+		var se *SyntaxError
+		if !errors.As(err, &se) {
+			t.Errorf("%q: Expected a syntax error, got %v", expr, err)
+		}
+	}
+}
+
+func kept(dice []Die) []int {
+	var values []int
+	for _, d := range dice {
+		if !d.Dropped && !d.Rerolled {
+			values = append(values, d.Value)
+		}
+	}
+	return values
+}
+
+func TestRoll(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	for i := 0; i < 1000; i++ {
+		res := mustParse(t, "4d6kh3+2").Roll(rng)
+		term := res.Terms[0]
+		if len(term.Dice) != 4 {
+			t.Fatalf("Expected 4 dice, got %v", term.Dice)
+		}
+		values := kept(term.Dice)
+		if len(values) != 3 {
+			t.Fatalf("Expected 3 kept dice, got %v", term.Dice)
+		}
+		sum := 0
+		for _, v := range values {
+			sum += v
+		}
+		for _, d := range term.Dice {
+			if d.Value < 1 || d.Value > 6 {
+				t.Fatalf("Die out of range: %v", term.Dice)
+			}
+			if d.Dropped && d.Value > values[0] && d.Value > values[1] && d.Value > values[2] {
+				t.Fatalf("Dropped a die higher than all kept: %v", term.Dice)
+			}
+		}
+		if term.Total != sum || res.Total != sum+2 {
+			t.Fatalf("Expected %d+2, got %d and %d", sum, term.Total, res.Total)
+		}
+
+		adv := mustParse(t, "d20dis").Roll(rng).Terms[0]
+		if len(adv.Dice) != 2 || adv.Total > adv.Dice[0].Value || adv.Total > adv.Dice[1].Value {
+			t.Fatalf("Expected the lower of two d20, got %+v", adv)
+		}
+
+		rerolled := mustParse(t, "2d6r<2").Roll(rng).Terms[0]
+		for _, d := range rerolled.Dice {
+			if d.Rerolled != (d.Value <= 2) {
+				t.Fatalf("Expected 1s and 2s rerolled, got %v", rerolled.Dice)
+			}
+		}
+
+		exploded := mustParse(t, "1d4!").Roll(rng).Terms[0]
+		for j, d := range exploded.Dice {
+			if d.Exploded != (d.Value == 4) || d.Exploded == (j == len(exploded.Dice)-1) {
+				t.Fatalf("Expected a die after each 4, got %v", exploded.Dice)
+			}
+		}
+	}
+}
+
+func TestRollSeed(t *testing.T) {
+	expr := mustParse(t, "8d6!r1+d20adv-3")
+	first := expr.RollSeed(42)
+	if first.Seed != 42 {
+		t.Errorf("Expected seed 42, got %d", first.Seed)
+	}
+	if again := expr.RollSeed(42); !reflect.DeepEqual(first, again) {
+		t.Errorf("Expected the same roll, got %+v and %+v", first, again)
+	}
+
+	res, err := Roll("2d6")
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if res.Seed >= 1<<53 {
+		t.Errorf("Expected a seed below 2^53, got %d", res.Seed)
+	}
+	if again := mustParse(t, "2d6").RollSeed(res.Seed); !reflect.DeepEqual(res, again) {
+		t.Errorf("Expected the seed to repeat %+v, got %+v", res, again)
+	}
+}
+
+func mustParse(t *testing.T, s string) *Expr {
+	t.Helper()
+	expr, err := Parse(s)
+	if err != nil {
+		t.Fatalf("%s: Unexpected error %v", s, err)
+	}
+	return expr
+}
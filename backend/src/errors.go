@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+)
+
+// Error codes, which clients can branch on instead of matching messages.
+const (
+	ERR_INVALID_TABLE      = "invalid_table"
+	ERR_INVALID_PARAMETER  = "invalid_parameter"
+	ERR_INVALID_FILTER     = "invalid_filter"
+	ERR_INVALID_BODY       = "invalid_body"
+	ERR_NOT_FOUND          = "not_found"
+	ERR_NOT_ACCEPTABLE     = "not_acceptable"
+	ERR_NO_ROUTE           = "no_route"
+	ERR_METHOD_NOT_ALLOWED = "method_not_allowed"
+	ERR_INTERNAL           = "internal_error"
+)
+
+const REQUEST_ID_HEADER = "X-Request-ID"
+
+// A request ID passed in by a client or proxy is kept if it looks like one.
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestID gives every response an X-Request-ID, reusing the request's
+// own when it has a usable one, so errors can be matched to the logs.
+func requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(REQUEST_ID_HEADER)
+		if !requestIDPattern.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(REQUEST_ID_HEADER, id)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// APIError is the body of every error response, inside an "error" field.
+type APIError struct {
+	Code      string                 `json:"code"`
+	Message   string                 `json:"message"`
+	RequestID string                 `json:"request_id"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+}
+
+type ErrorEnvelope struct {
+	Error APIError `json:"error"`
+}
+
+// writeError writes the error envelope with the request ID requestID set,
+// making one up for responses that don't pass through it.
+func writeError(w http.ResponseWriter, r *http.Request, status int, code string, message string, details map[string]interface{}) {
+	id := w.Header().Get(REQUEST_ID_HEADER)
+	if id == "" {
+		id = newRequestID()
+		w.Header().Set(REQUEST_ID_HEADER, id)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ErrorEnvelope{APIError{
+		Code:      code,
+		Message:   message,
+		RequestID: id,
+		Details:   details,
+	}})
+}
+
+func writeInvalidTable(w http.ResponseWriter, r *http.Request, table string) {
+	writeError(w, r, http.StatusBadRequest, ERR_INVALID_TABLE, "Invalid table", map[string]interface{}{
+		"table":  table,
+		"tables": TABLE_NAMES,
+	})
+}
+
+// ParamError is a problem with one query parameter.
+type ParamError struct {
+	Param string
+	Err   error
+}
+
+func (e *ParamError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ParamError) Unwrap() error {
+	return e.Err
+}
+
+func paramError(param string, format string, args ...interface{}) error {
+	return &ParamError{param, fmt.Errorf(format, args...)}
+}
+
+// writeInvalidParameter names the parameter in the details when err is a
+// ParamError, and reports a FilterError as invalid_filter.
+func writeInvalidParameter(w http.ResponseWriter, r *http.Request, err error) {
+	code := ERR_INVALID_PARAMETER
+	var details map[string]interface{}
+	var pe *ParamError
+	if errors.As(err, &pe) {
+		details = map[string]interface{}{"parameter": pe.Param}
+	}
+	// Filter errors also say where in the expression the problem is.
+	var fe *FilterError
+	if errors.As(err, &fe) {
+		code = ERR_INVALID_FILTER
+		if details == nil {
+			details = map[string]interface{}{}
+		}
+		details["position"] = fe.Pos + 1
+	}
+	writeError(w, r, http.StatusBadRequest, code, err.Error(), details)
+}
+
+func writeNoResults(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusNotFound, ERR_NOT_FOUND, "No results", nil)
+}
+
+// writeInternalError hides the cause, which is logged instead.
+func writeInternalError(w http.ResponseWriter, r *http.Request, message string) {
+	writeError(w, r, http.StatusInternalServerError, ERR_INTERNAL, message, nil)
+}
+
+func noRouteHandler(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusNotFound, ERR_NO_ROUTE, "No such endpoint, see /capabilities", map[string]interface{}{
+		"path": r.URL.Path,
+	})
+}
+
+func methodNotAllowedHandler(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", map[string]interface{}{
+		"method": r.Method,
+	})
+}
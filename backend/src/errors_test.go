@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestSqliteErrors(t *testing.T) {
+	srv := newSqliteTestServer(t)
+
+	cases := []struct {
+		path    string
+		accept  string
+		status  int
+		code    string
+		details string
+	}{
+		{"/v1/not_a_table/aboleth", "", http.StatusBadRequest, ERR_INVALID_TABLE, "tables"},
+		{"/all/not_a_table", "", http.StatusBadRequest, ERR_INVALID_TABLE, "tables"},
+		{"/v1/capabilities/not_a_table", "", http.StatusBadRequest, ERR_INVALID_TABLE, "tables"},
+		{"/v1/monsters/not-a-monster", "", http.StatusNotFound, ERR_NOT_FOUND, ""},
+		{"/all/spells?limit=0", "", http.StatusBadRequest, ERR_INVALID_PARAMETER, "parameter"},
+		{"/all/spells?filter=level%3C%3D3.5", "", http.StatusBadRequest, ERR_INVALID_FILTER, "position"},
+		{"/v1/spells/fireball", "image/png", http.StatusNotAcceptable, ERR_NOT_ACCEPTABLE, "formats"},
+		{"/v1/spells/fireball/references/extra", "", http.StatusNotFound, ERR_NO_ROUTE, "path"},
+	}
+
+	for _, c := range cases {
+		req, _ := http.NewRequest("GET", srv.URL+c.path, nil)
+		if c.accept != "" {
+			req.Header.Set("Accept", c.accept)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+
+		var body ErrorEnvelope
+		err = json.NewDecoder(res.Body).Decode(&body)
+		res.Body.Close()
+		if err != nil {
+			t.Errorf("%s: Failed to decode error: %v", c.path, err)
+			continue
+		}
+
+		if res.StatusCode != c.status || body.Error.Code != c.code {
+			t.Errorf("%s: Expected %d %s, got %d %s", c.path, c.status, c.code, res.StatusCode, body.Error.Code)
+		}
+		if body.Error.RequestID == "" || body.Error.RequestID != res.Header.Get(REQUEST_ID_HEADER) {
+			t.Errorf("%s: Expected request ID %q to match the header %q",
+				c.path, body.Error.RequestID, res.Header.Get(REQUEST_ID_HEADER))
+		}
+		if _, ok := body.Error.Details[c.details]; c.details != "" && !ok {
+			t.Errorf("%s: Expected %s in details, got %v", c.path, c.details, body.Error.Details)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", srv.URL+"/not_a_table", nil)
+	req.Header.Set(REQUEST_ID_HEADER, "trace-123")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	defer res.Body.Close()
+	var body ErrorEnvelope
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		t.Fatalf("Failed to decode error: %v", err)
+	}
+	if body.Error.RequestID != "trace-123" {
+		t.Errorf("Expected the client's request ID to be kept, got %q", body.Error.RequestID)
+	}
+}
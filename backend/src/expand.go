@@ -0,0 +1,402 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// MAX_EXPAND_DEPTH bounds how many references deep ?expand= will follow.
+const MAX_EXPAND_DEPTH = 3
+
+// URL_PATTERNS maps the shape of a row url (see urlPattern) to the tables
+// whose rows have urls of that shape. It is filled in by registerTables.
+var URL_PATTERNS = map[string][]string{}
+
+// urlPattern replaces the variable parts of an SRD url with "*", so
+// "/classes/wizard/levels/3" becomes "classes/*/levels/*".
+func urlPattern(u string) string {
+	segments := strings.Split(strings.Trim(u, "/"), "/")
+	for i := 1; i < len(segments); i += 2 {
+		segments[i] = "*"
+	}
+	return strings.Join(segments, "/")
+}
+
+func buildUrlPatterns(datasets []Dataset) map[string][]string {
+	patterns := make(map[string][]string)
+	for _, ds := range datasets {
+		seen := make(map[string]bool)
+		for _, row := range ds.Data {
+			u, ok := row["url"].(string)
+			if !ok {
+				continue
+			}
+			pattern := urlPattern(u)
+			if !seen[pattern] {
+				seen[pattern] = true
+				patterns[pattern] = append(patterns[pattern], ds.Table.Name)
+			}
+		}
+	}
+	return patterns
+}
+
+// isReference reports whether v is an embedded link such as
+// {"index": "skill-history", "name": "Skill: History", "url": "/proficiencies/skill-history"}.
+func isReference(v map[string]interface{}) (string, bool) {
+	u, ok := v["url"].(string)
+	if !ok {
+		return "", false
+	}
+	if _, ok := v["index"].(string); !ok {
+		return "", false
+	}
+	return u, true
+}
+
+// ExpandSelector decides which field paths get their references inlined.
+// Paths are dotted field names; array elements share their array's path.
+type ExpandSelector struct {
+	all   bool
+	paths map[string]bool
+	depth int
+}
+
+func parseExpand(query url.Values) (*ExpandSelector, error) {
+	if !query.Has("expand") {
+		return nil, nil
+	}
+
+	sel := &ExpandSelector{paths: make(map[string]bool)}
+	for _, p := range strings.Split(query.Get("expand"), ",") {
+		p = strings.TrimSpace(p)
+		switch p {
+		case "":
+		case "*":
+			sel.all = true
+		default:
+			sel.paths[p] = true
+		}
+	}
+	if len(sel.paths) == 0 {
+		sel.all = true
+	}
+
+	// Expanding everything defaults to one level; named paths are only
+	// bounded by their own length and the maximum depth.
+	sel.depth = MAX_EXPAND_DEPTH
+	if sel.all {
+		sel.depth = 1
+	}
+	if d := query.Get("depth"); d != "" {
+		depth, err := strconv.Atoi(d)
+		if err != nil || depth < 1 || depth > MAX_EXPAND_DEPTH {
+			return nil, paramError("depth", "depth must be between 1 and %d", MAX_EXPAND_DEPTH)
+		}
+		sel.depth = depth
+	}
+
+	return sel, nil
+}
+
+func (sel *ExpandSelector) expands(path string) bool {
+	return sel.all || sel.paths[path]
+}
+
+func (sel *ExpandSelector) descends(path string) bool {
+	if sel.all {
+		return true
+	}
+	for p := range sel.paths {
+		if strings.HasPrefix(p, path+".") {
+			return true
+		}
+	}
+	return false
+}
+
+type expandSlot struct {
+	path      string
+	url       string
+	ancestors map[string]bool
+	set       func(interface{})
+}
+
+func joinPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func (sel *ExpandSelector) collect(v interface{}, path string, ancestors map[string]bool,
+	set func(interface{}), slots []expandSlot) []expandSlot {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if u, ok := isReference(v); ok && path != "" && sel.expands(path) && !ancestors[u] {
+			return append(slots, expandSlot{path, u, ancestors, set})
+		}
+		for key, child := range v {
+			childPath := joinPath(path, key)
+			if sel.expands(childPath) || sel.descends(childPath) {
+				slots = sel.collect(child, childPath, ancestors, func(value interface{}) {
+					v[key] = value
+				}, slots)
+			}
+		}
+	case []interface{}:
+		for i, child := range v {
+			slots = sel.collect(child, path, ancestors, func(value interface{}) {
+				v[i] = value
+			}, slots)
+		}
+	}
+	return slots
+}
+
+// ReferenceFetcher loads the rows behind a set of reference urls, keyed by url.
+type ReferenceFetcher func(urls []string) (map[string]map[string]interface{}, error)
+
+// expandRows inlines the selected references in rows in place, one level at a
+// time so each level costs a single fetch. A reference is never expanded
+// inside itself, which stops cycles such as class -> subclass -> class.
+func expandRows(rows []map[string]interface{}, sel *ExpandSelector, fetch ReferenceFetcher) error {
+	var slots []expandSlot
+	for _, row := range rows {
+		ancestors := map[string]bool{}
+		if u, ok := row["url"].(string); ok {
+			ancestors[u] = true
+		}
+		slots = sel.collect(row, "", ancestors, nil, slots)
+	}
+
+	for depth := 0; depth < sel.depth && len(slots) > 0; depth++ {
+		urls := make([]string, 0, len(slots))
+		seen := make(map[string]bool)
+		for _, slot := range slots {
+			if !seen[slot.url] {
+				seen[slot.url] = true
+				urls = append(urls, slot.url)
+			}
+		}
+
+		fetched, err := fetch(urls)
+		if err != nil {
+			return err
+		}
+
+		var next []expandSlot
+		for _, slot := range slots {
+			row, ok := fetched[slot.url]
+			if !ok {
+				continue
+			}
+			// Each slot gets its own copy so deeper levels can be expanded
+			// differently depending on where the row was inlined.
+			row = cloneValue(row).(map[string]interface{})
+			slot.set(row)
+
+			ancestors := make(map[string]bool, len(slot.ancestors)+1)
+			for u := range slot.ancestors {
+				ancestors[u] = true
+			}
+			ancestors[slot.url] = true
+			for key, child := range row {
+				childPath := joinPath(slot.path, key)
+				if sel.expands(childPath) || sel.descends(childPath) {
+					next = sel.collect(child, childPath, ancestors, func(value interface{}) {
+						row[key] = value
+					}, next)
+				}
+			}
+		}
+		slots = next
+	}
+
+	return nil
+}
+
+func cloneValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		c := make(map[string]interface{}, len(v))
+		for k, child := range v {
+			c[k] = cloneValue(child)
+		}
+		return c
+	case []interface{}:
+		c := make([]interface{}, len(v))
+		for i, child := range v {
+			c[i] = cloneValue(child)
+		}
+		return c
+	default:
+		return v
+	}
+}
+
+// referenceTables groups urls by the tables that have rows of their shape.
+func referenceTables(urls []string) map[string][]interface{} {
+	byTable := make(map[string][]interface{})
+	for _, u := range urls {
+		for _, table := range URL_PATTERNS[urlPattern(u)] {
+			byTable[table] = append(byTable[table], u)
+		}
+	}
+	return byTable
+}
+
+// fetchUrls loads the rows of one table with the given urls in one query.
+func (dbc DbClient) fetchUrls(table string, urls []interface{}) ([]map[string]interface{}, error) {
+	placeholders := make([]string, len(urls))
+	for i := range urls {
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+	}
+	query := fmt.Sprintf("SELECT * FROM %s WHERE url IN (%s)",
+		table, strings.Join(placeholders, ", "))
+	return queryMaps(dbc.DB, query, urls...)
+}
+
+// fetchReferences is the ReferenceFetcher backed by the database. Urls are
+// grouped by shape so each candidate table is queried once.
+func (dbc DbClient) fetchReferences(urls []string) (map[string]map[string]interface{}, error) {
+	fetched := make(map[string]map[string]interface{})
+	for table, params := range referenceTables(urls) {
+		rows, err := dbc.fetchUrls(table, params)
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			if u, ok := row["url"].(string); ok {
+				fetched[u] = row
+			}
+		}
+	}
+
+	return fetched, nil
+}
+
+// queryMaps runs a query and returns its rows with JSON columns decoded, for
+// callers that need to work on the rows before writing them out.
+func queryMaps(db *sql.DB, query string, params ...interface{}) ([]map[string]interface{}, error) {
+	rows, err := db.Query(query, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	colTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([]interface{}, len(columns))
+	valuePtrs := make([]interface{}, len(columns))
+	for i := range values {
+		valuePtrs[i] = &values[i]
+	}
+
+	results := []map[string]interface{}{}
+	for rows.Next() {
+		if err := rows.Scan(valuePtrs...); err != nil {
+			return nil, err
+		}
+
+		result := make(map[string]interface{}, len(columns))
+		for i, col := range columns {
+			val := decodeColumn(colTypes[i], values[i])
+			if raw, ok := val.(json.RawMessage); ok {
+				var decoded interface{}
+				if err := json.Unmarshal(raw, &decoded); err != nil {
+					return nil, err
+				}
+				val = decoded
+			}
+			result[convertToKey(col)] = val
+		}
+		results = append(results, result)
+	}
+
+	return results, rows.Err()
+}
+
+// QueryDbMaps is queryDb for requests that need the rows of a table in
+// memory before writing them out, either to inline references for ?expand=
+// (when sel is set) or to serve them from ROW_CACHE.
+func (dbc DbClient) QueryDbMaps(
+	w http.ResponseWriter,
+	r *http.Request,
+	log *logrus.Entry,
+	table string,
+	sel *ExpandSelector,
+	single bool,
+	query string,
+	params ...interface{},
+) error {
+	log = log.WithFields(logrus.Fields{
+		"method": r.Method,
+		"ip":     r.RemoteAddr,
+		"query":  query,
+		"params": params,
+	})
+	addVary(w.Header(), "Accept")
+	format, err := negotiateFormat(r)
+	if err != nil {
+		notAcceptable(w, r, log, err)
+		return nil
+	}
+
+	rows, err := dbc.queryMapsCached(table, query, params...)
+	if err != nil {
+		log.WithError(err).Warn("Failed to query database")
+		writeInternalError(w, r, "Failed to query database")
+		return err
+	}
+
+	if len(rows) == 0 && single {
+		log.Warn("No results")
+		writeNoResults(w, r)
+		return nil
+	}
+
+	if sel != nil {
+		// Expanding writes into the rows, which may be shared with the cache.
+		expanded := make([]map[string]interface{}, len(rows))
+		for i, row := range rows {
+			expanded[i] = cloneValue(row).(map[string]interface{})
+		}
+		rows = expanded
+
+		if err := expandRows(rows, sel, dbc.fetchReferences); err != nil {
+			log.WithError(err).Warn("Failed to expand references")
+			writeInternalError(w, r, "Failed to expand references")
+			return err
+		}
+	}
+
+	out := newRowWriter(w, format, single)
+	for _, row := range rows {
+		if err := out.WriteRow(row); err != nil {
+			log.WithError(err).Warn("Failed to encode result")
+			return err
+		}
+	}
+	if err := out.Close(); err != nil {
+		log.WithError(err).Warn("Failed to encode result")
+		return err
+	}
+
+	log.Info("Finished query")
+	return nil
+}
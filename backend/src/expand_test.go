@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func ref(index string, u string) map[string]interface{} {
+	return map[string]interface{}{"index": index, "name": index, "url": u}
+}
+
+func fakeFetcher(rows ...map[string]interface{}) (ReferenceFetcher, *int) {
+	calls := 0
+	return func(urls []string) (map[string]map[string]interface{}, error) {
+		calls++
+		fetched := make(map[string]map[string]interface{})
+		for _, u := range urls {
+			for _, row := range rows {
+				if row["url"] == u {
+					fetched[u] = row
+				}
+			}
+		}
+		return fetched, nil
+	}, &calls
+}
+
+func TestUrlPattern(t *testing.T) {
+	cases := map[string]string{
+		"/classes/wizard":          "classes/*",
+		"/classes/wizard/levels/3": "classes/*/levels/*",
+		"/equipment/club":          "equipment/*",
+	}
+	for u, want := range cases {
+		if got := urlPattern(u); got != want {
+			t.Errorf("urlPattern(%s): expected %s, got %s", u, want, got)
+		}
+	}
+}
+
+func TestExpandRows(t *testing.T) {
+	evocation := map[string]interface{}{
+		"index": "evocation", "name": "Evocation", "url": "/magic-schools/evocation",
+		"desc": "Evocation spells manipulate energy.",
+	}
+	wizard := map[string]interface{}{
+		"index": "wizard", "name": "Wizard", "url": "/classes/wizard",
+		"spells": []interface{}{ref("fireball", "/spells/fireball")},
+	}
+	fetch, calls := fakeFetcher(evocation, wizard)
+
+	fireball := map[string]interface{}{
+		"index":   "fireball",
+		"url":     "/spells/fireball",
+		"school":  ref("evocation", "/magic-schools/evocation"),
+		"classes": []interface{}{ref("wizard", "/classes/wizard")},
+	}
+
+	sel, err := parseExpand(url.Values{"expand": {"school"}})
+	if err != nil {
+		t.Fatalf("Failed to parse expand: %v", err)
+	}
+	if err := expandRows([]map[string]interface{}{fireball}, sel, fetch); err != nil {
+		t.Fatalf("Failed to expand rows: %v", err)
+	}
+
+	school := fireball["school"].(map[string]interface{})
+	if school["desc"] != evocation["desc"] {
+		t.Errorf("Expected school to be expanded, got %v", school)
+	}
+	class := fireball["classes"].([]interface{})[0].(map[string]interface{})
+	if _, ok := class["spells"]; ok {
+		t.Errorf("Expected classes to be left alone, got %v", class)
+	}
+	if *calls != 1 {
+		t.Errorf("Expected 1 fetch, got %d", *calls)
+	}
+}
+
+func TestExpandRowsStopsCycles(t *testing.T) {
+	wizard := map[string]interface{}{
+		"index": "wizard", "name": "Wizard", "url": "/classes/wizard",
+		"spells": []interface{}{ref("fireball", "/spells/fireball")},
+	}
+	fetch, _ := fakeFetcher(wizard)
+
+	fireball := map[string]interface{}{
+		"index":   "fireball",
+		"url":     "/spells/fireball",
+		"classes": []interface{}{ref("wizard", "/classes/wizard")},
+	}
+
+	sel, err := parseExpand(url.Values{"expand": {"*"}, "depth": {"3"}})
+	if err != nil {
+		t.Fatalf("Failed to parse expand: %v", err)
+	}
+	if err := expandRows([]map[string]interface{}{fireball}, sel, fetch); err != nil {
+		t.Fatalf("Failed to expand rows: %v", err)
+	}
+
+	class := fireball["classes"].([]interface{})[0].(map[string]interface{})
+	spell := class["spells"].([]interface{})[0].(map[string]interface{})
+	if _, ok := spell["classes"]; ok {
+		t.Errorf("Expected the spell not to be expanded inside itself, got %v", spell)
+	}
+}
+
+func TestParseExpandDepth(t *testing.T) {
+	if _, err := parseExpand(url.Values{"expand": {"*"}, "depth": {"10"}}); err == nil {
+		t.Errorf("Expected an error for a depth over the maximum")
+	}
+	sel, err := parseExpand(url.Values{})
+	if err != nil || sel != nil {
+		t.Errorf("Expected no selector without expand, got %v, %v", sel, err)
+	}
+}
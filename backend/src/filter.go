@@ -0,0 +1,561 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The ?filter= language. A filter is one or more comparisons joined with
+// AND, OR, NOT and parentheses:
+//
+//	level<=3 AND school.index=evocation
+//	challenge_rating BETWEEN 1 AND 5
+//	classes.index=wizard OR name~"magic"
+//	size IN (Large, Huge) AND NOT subtype IS NULL
+//
+// Fields are columns of the table, optionally followed by a dotted path into
+// a JSON column; arrays along the path match if any element does. Operators
+// are = != < <= > >= ~ (case-insensitive contains), BETWEEN, IN and IS
+// [NOT] NULL. Values are numbers, true/false, or text, quoted if they contain
+// spaces or punctuation.
+
+type FilterError struct {
+	Pos int
+	Msg string
+}
+
+func (e *FilterError) Error() string {
+	return fmt.Sprintf("invalid filter at position %d: %s", e.Pos+1, e.Msg)
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokWord
+	tokString
+	tokOp
+	tokLParen
+	tokRParen
+	tokComma
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func isWordChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		strings.IndexByte("_.-+/:", c) >= 0
+}
+
+func lexFilter(input string) ([]token, error) {
+	var tokens []token
+	i := 0
+	for i < len(input) {
+		c := input[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '(':
+			tokens = append(tokens, token{tokLParen, "(", i})
+			i++
+		case c == ')':
+			tokens = append(tokens, token{tokRParen, ")", i})
+			i++
+		case c == ',':
+			tokens = append(tokens, token{tokComma, ",", i})
+			i++
+		case c == '"' || c == '\'':
+			start := i
+			var s strings.Builder
+			i++
+			for i < len(input) && input[i] != c {
+				if input[i] == '\\' && i+1 < len(input) {
+					i++
+				}
+				s.WriteByte(input[i])
+				i++
+			}
+			if i >= len(input) {
+				return nil, &FilterError{start, "unterminated string"}
+			}
+			i++
+			tokens = append(tokens, token{tokString, s.String(), start})
+		case strings.IndexByte("=!<>~", c) >= 0:
+			start := i
+			op := string(c)
+			if i+1 < len(input) && input[i+1] == '=' && c != '=' && c != '~' {
+				op += "="
+			}
+			if op == "!" {
+				return nil, &FilterError{start, "expected !="}
+			}
+			i += len(op)
+			tokens = append(tokens, token{tokOp, op, start})
+		case isWordChar(c):
+			start := i
+			for i < len(input) && isWordChar(input[i]) {
+				i++
+			}
+			tokens = append(tokens, token{tokWord, input[start:i], start})
+		default:
+			return nil, &FilterError{i, fmt.Sprintf("unexpected character %q", c)}
+		}
+	}
+	return append(tokens, token{tokEOF, "", len(input)}), nil
+}
+
+type filterValue struct {
+	kind string // "text", "number", "integer" or "bool"
+	text string
+	num  float64
+	b    bool
+	pos  int
+}
+
+func (v filterValue) param() interface{} {
+	switch v.kind {
+	case "number":
+		return v.num
+	case "integer":
+		return int64(v.num)
+	case "bool":
+		return v.b
+	default:
+		return v.text
+	}
+}
+
+type filterNode interface{}
+
+type filterAnd struct{ left, right filterNode }
+type filterOr struct{ left, right filterNode }
+type filterNot struct{ expr filterNode }
+
+type filterCmp struct {
+	path   []string
+	pos    int
+	op     string // = != < <= > >= ~ BETWEEN IN NULL NOTNULL
+	values []filterValue
+}
+
+type filterParser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *filterParser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *filterParser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *filterParser) keyword(word string) bool {
+	t := p.peek()
+	if t.kind == tokWord && strings.EqualFold(t.text, word) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func describeToken(t token) string {
+	if t.kind == tokEOF {
+		return "end of filter"
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+func parseFilter(input string) (filterNode, error) {
+	tokens, err := lexFilter(input)
+	if err != nil {
+		return nil, err
+	}
+	p := &filterParser{tokens: tokens}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, &FilterError{t.pos, "unexpected " + describeToken(t)}
+	}
+	return node, nil
+}
+
+func (p *filterParser) parseOr() (filterNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("OR") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = filterOr{left, right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (filterNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("AND") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = filterAnd{left, right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseUnary() (filterNode, error) {
+	if p.keyword("NOT") {
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return filterNot{expr}, nil
+	}
+
+	if p.peek().kind == tokLParen {
+		p.next()
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if t := p.next(); t.kind != tokRParen {
+			return nil, &FilterError{t.pos, "expected ) but found " + describeToken(t)}
+		}
+		return expr, nil
+	}
+
+	return p.parseCmp()
+}
+
+var filterPathSegment = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+func (p *filterParser) parseCmp() (filterNode, error) {
+	t := p.next()
+	if t.kind != tokWord {
+		return nil, &FilterError{t.pos, "expected a field but found " + describeToken(t)}
+	}
+	path := strings.Split(t.text, ".")
+	for _, segment := range path {
+		if !filterPathSegment.MatchString(segment) {
+			return nil, &FilterError{t.pos, fmt.Sprintf("invalid field %q", t.text)}
+		}
+	}
+	cmp := filterCmp{path: path, pos: t.pos}
+
+	switch op := p.peek(); {
+	case op.kind == tokOp:
+		p.next()
+		cmp.op = op.text
+		v, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		cmp.values = []filterValue{v}
+	case p.keyword("BETWEEN"):
+		cmp.op = "BETWEEN"
+		low, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		if !p.keyword("AND") {
+			t := p.peek()
+			return nil, &FilterError{t.pos, "expected AND in BETWEEN but found " + describeToken(t)}
+		}
+		high, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		cmp.values = []filterValue{low, high}
+	case p.keyword("IN"):
+		cmp.op = "IN"
+		if t := p.next(); t.kind != tokLParen {
+			return nil, &FilterError{t.pos, "expected ( after IN but found " + describeToken(t)}
+		}
+		for {
+			v, err := p.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			cmp.values = append(cmp.values, v)
+			t := p.next()
+			if t.kind == tokRParen {
+				break
+			}
+			if t.kind != tokComma {
+				return nil, &FilterError{t.pos, "expected , or ) but found " + describeToken(t)}
+			}
+		}
+	case p.keyword("IS"):
+		cmp.op = "NULL"
+		if p.keyword("NOT") {
+			cmp.op = "NOTNULL"
+		}
+		if !p.keyword("NULL") {
+			t := p.peek()
+			return nil, &FilterError{t.pos, "expected NULL but found " + describeToken(t)}
+		}
+	default:
+		return nil, &FilterError{op.pos, "expected an operator after " + t.text +
+			" but found " + describeToken(op)}
+	}
+
+	return cmp, nil
+}
+
+func (p *filterParser) parseValue() (filterValue, error) {
+	t := p.next()
+	switch t.kind {
+	case tokString:
+		return filterValue{kind: "text", text: t.text, pos: t.pos}, nil
+	case tokWord:
+		if strings.EqualFold(t.text, "true") || strings.EqualFold(t.text, "false") {
+			return filterValue{kind: "bool", text: t.text, b: strings.EqualFold(t.text, "true"), pos: t.pos}, nil
+		}
+		if n, err := strconv.ParseFloat(t.text, 64); err == nil {
+			return filterValue{kind: "number", text: t.text, num: n, pos: t.pos}, nil
+		}
+		return filterValue{kind: "text", text: t.text, pos: t.pos}, nil
+	default:
+		return filterValue{}, &FilterError{t.pos, "expected a value but found " + describeToken(t)}
+	}
+}
+
+// JsonScalar holds SQL expressions for a scalar found inside a JSON column,
+// typed so that comparisons never mix numbers and text. Each is NULL when
+// the scalar is of another type.
+type JsonScalar struct {
+	Text    string
+	Number  string
+	Bool    string
+	NotNull string
+}
+
+type filterCompiler struct {
+	table   FiveETable
+	dialect Dialect
+	start   int
+	params  []interface{}
+}
+
+// compileFilter turns a ?filter= expression into a SQL condition for table,
+// with placeholders numbered after the first start parameters.
+func compileFilter(table FiveETable, dialect Dialect, input string, start int) (string, []interface{}, error) {
+	node, err := parseFilter(input)
+	if err != nil {
+		return "", nil, err
+	}
+
+	c := &filterCompiler{table: table, dialect: dialect, start: start}
+	where, err := c.compile(node)
+	if err != nil {
+		return "", nil, err
+	}
+	return where, c.params, nil
+}
+
+func (c *filterCompiler) param(v interface{}) string {
+	c.params = append(c.params, v)
+	return fmt.Sprintf("$%d", c.start+len(c.params))
+}
+
+func (c *filterCompiler) compile(node filterNode) (string, error) {
+	switch n := node.(type) {
+	case filterAnd:
+		left, err := c.compile(n.left)
+		if err != nil {
+			return "", err
+		}
+		right, err := c.compile(n.right)
+		if err != nil {
+			return "", err
+		}
+		return "(" + left + " AND " + right + ")", nil
+	case filterOr:
+		left, err := c.compile(n.left)
+		if err != nil {
+			return "", err
+		}
+		right, err := c.compile(n.right)
+		if err != nil {
+			return "", err
+		}
+		return "(" + left + " OR " + right + ")", nil
+	case filterNot:
+		expr, err := c.compile(n.expr)
+		if err != nil {
+			return "", err
+		}
+		return "(NOT " + expr + ")", nil
+	case filterCmp:
+		return c.compileCmp(n)
+	default:
+		return "", fmt.Errorf("unknown filter node %T", node)
+	}
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// comparison applies op to the SQL expression expr. Values have already been
+// checked to suit expr.
+func (c *filterCompiler) comparison(expr string, op string, values []filterValue) string {
+	switch op {
+	case "~":
+		return "lower(" + expr + ") LIKE lower(" + c.param("%"+escapeLike(values[0].text)+"%") + ") ESCAPE '\\'"
+	case "BETWEEN":
+		return expr + " BETWEEN " + c.param(values[0].param()) + " AND " + c.param(values[1].param())
+	case "IN":
+		placeholders := make([]string, len(values))
+		for i, v := range values {
+			placeholders[i] = c.param(v.param())
+		}
+		return expr + " IN (" + strings.Join(placeholders, ", ") + ")"
+	case "!=":
+		return expr + " <> " + c.param(values[0].param())
+	default:
+		return expr + " " + op + " " + c.param(values[0].param())
+	}
+}
+
+func (c *filterCompiler) compileCmp(cmp filterCmp) (string, error) {
+	field := strings.Join(cmp.path, ".")
+	column := cmp.path[0]
+	if !hasColumn(c.table, column) {
+		return "", &FilterError{cmp.pos, fmt.Sprintf("unknown field %q", column)}
+	}
+	colType := c.table.Types[column]
+
+	if colType == JSONB {
+		return c.compileJson(cmp, field)
+	}
+	if len(cmp.path) > 1 {
+		return "", &FilterError{cmp.pos, fmt.Sprintf("%s has no nested fields", column)}
+	}
+
+	col := convertKey(column)
+	switch cmp.op {
+	case "NULL":
+		return col + " IS NULL", nil
+	case "NOTNULL":
+		return col + " IS NOT NULL", nil
+	}
+
+	values := cmp.values
+	switch colType {
+	case INTEGER, NUMERIC:
+		if cmp.op == "~" {
+			return "", &FilterError{cmp.pos, fmt.Sprintf("~ needs text but %s is a number", field)}
+		}
+		checked := make([]filterValue, len(values))
+		for i, v := range values {
+			if v.kind != "number" || math.IsNaN(v.num) || math.IsInf(v.num, 0) {
+				return "", &FilterError{v.pos, fmt.Sprintf("%s is a number but %q is not", field, v.text)}
+			}
+			// Postgres won't compare an integer column with a fraction.
+			if colType == INTEGER {
+				if v.num != math.Trunc(v.num) {
+					return "", &FilterError{v.pos, fmt.Sprintf("%s is a whole number but %q is not", field, v.text)}
+				}
+				if math.Abs(v.num) > 1<<53 {
+					return "", &FilterError{v.pos, fmt.Sprintf("%q is out of range for %s", v.text, field)}
+				}
+				v.kind = "integer"
+			}
+			checked[i] = v
+		}
+		values = checked
+	case BOOLEAN:
+		if cmp.op != "=" && cmp.op != "!=" {
+			return "", &FilterError{cmp.pos, fmt.Sprintf("%s is true or false and only supports = and !=", field)}
+		}
+		if values[0].kind != "bool" {
+			return "", &FilterError{values[0].pos, fmt.Sprintf("%s is true or false but %q is not", field, values[0].text)}
+		}
+	default:
+		// Text columns compare against the value as written.
+		text := make([]filterValue, len(values))
+		for i, v := range values {
+			text[i] = filterValue{kind: "text", text: v.text, pos: v.pos}
+		}
+		values = text
+	}
+
+	if cmp.op == "!=" {
+		return "(" + col + " IS NULL OR " + c.comparison(col, cmp.op, values) + ")", nil
+	}
+	return c.comparison(col, cmp.op, values), nil
+}
+
+// compileJson matches when any scalar at the path satisfies the comparison.
+// != and IS NULL hold when no scalar there matches instead.
+func (c *filterCompiler) compileJson(cmp filterCmp, field string) (string, error) {
+	column := convertKey(cmp.path[0])
+	path := cmp.path[1:]
+
+	switch cmp.op {
+	case "NULL", "NOTNULL":
+		exists := c.dialect.JsonMatch(column, path, func(v JsonScalar) string {
+			return v.NotNull
+		})
+		if cmp.op == "NULL" {
+			return "(NOT " + exists + ")", nil
+		}
+		return exists, nil
+	}
+
+	kind := cmp.values[0].kind
+	for _, v := range cmp.values {
+		if v.kind != kind {
+			return "", &FilterError{v.pos, fmt.Sprintf("values for %s must all be of one type", field)}
+		}
+	}
+	if cmp.op == "~" && kind != "text" {
+		kind = "text"
+		cmp.values[0] = filterValue{kind: "text", text: cmp.values[0].text}
+	}
+	if kind == "bool" && cmp.op != "=" && cmp.op != "!=" {
+		return "", &FilterError{cmp.pos, "true and false only support = and !="}
+	}
+
+	op := cmp.op
+	if op == "!=" {
+		op = "="
+	}
+	match := c.dialect.JsonMatch(column, path, func(v JsonScalar) string {
+		expr := v.Text
+		switch kind {
+		case "number":
+			expr = v.Number
+		case "bool":
+			expr = v.Bool
+		}
+		return c.comparison(expr, op, cmp.values)
+	})
+
+	if cmp.op == "!=" {
+		return "(NOT " + match + ")", nil
+	}
+	return match, nil
+}
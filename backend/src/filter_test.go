@@ -0,0 +1,47 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCompileFilter(t *testing.T) {
+	table := FiveETable{
+		Name:    "spells",
+		Mapping: []string{"index", "name", "level", "ritual", "school", "classes"},
+		Types: map[string]string{
+			"index": TEXT, "name": TEXT, "level": INTEGER,
+			"ritual": BOOLEAN, "school": JSONB, "classes": JSONB,
+		},
+	}
+
+	where, params, err := compileFilter(table, POSTGRES, "level<=3 AND (name~\"fire\" OR ritual=true)", 0)
+	if err != nil {
+		t.Fatalf("Failed to compile filter: %v", err)
+	}
+	if !strings.Contains(where, "level <= $1") || len(params) != 3 {
+		t.Errorf("Unexpected compiled filter %q with params %v", where, params)
+	}
+
+	if params[0] != int64(3) {
+		t.Errorf("Expected an integer parameter for level, got %T %v", params[0], params[0])
+	}
+
+	invalid := []string{
+		"level <=",
+		"nope = 1",
+		"level = abc",
+		"(level = 1",
+		"level BETWEEN 1",
+		"level <= 3.5",
+		"level = 1e300",
+		"level = NaN",
+	}
+	for _, input := range invalid {
+		if _, _, err := compileFilter(table, POSTGRES, input, 0); err == nil {
+			t.Errorf("Expected an error compiling %q", input)
+		} else if _, ok := err.(*FilterError); !ok {
+			t.Errorf("Expected a FilterError compiling %q, got %v", input, err)
+		}
+	}
+}
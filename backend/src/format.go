@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Format is a representation rows can be written in, picked per request by
+// ?format= or the Accept header.
+type Format struct {
+	Name        string
+	ContentType string
+	MediaTypes  []string
+}
+
+var (
+	FORMAT_JSON   = Format{"json", "application/json", []string{"application/json"}}
+	FORMAT_NDJSON = Format{"ndjson", "application/x-ndjson", []string{"application/x-ndjson", "application/ndjson"}}
+	FORMAT_CSV    = Format{"csv", "text/csv; charset=utf-8", []string{"text/csv"}}
+	FORMAT_YAML   = Format{"yaml", "application/yaml", []string{"application/yaml", "application/x-yaml", "text/yaml"}}
+)
+
+var FORMATS = []Format{FORMAT_JSON, FORMAT_NDJSON, FORMAT_CSV, FORMAT_YAML}
+
+func formatNames() []string {
+	names := make([]string, len(FORMATS))
+	for i, f := range FORMATS {
+		names[i] = f.Name
+	}
+	return names
+}
+
+type acceptRange struct {
+	mediaType string
+	q         float64
+}
+
+// parseAccept lists the media ranges of an Accept header, most preferred
+// first. Ranges with equal weight keep the order they were given in.
+func parseAccept(header string) []acceptRange {
+	var ranges []acceptRange
+	for _, part := range strings.Split(header, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if q > 0 {
+			ranges = append(ranges, acceptRange{mediaType, q})
+		}
+	}
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return ranges[i].q > ranges[j].q
+	})
+	return ranges
+}
+
+// addVary names a request header the response depends on, once.
+func addVary(h http.Header, field string) {
+	for _, v := range h.Values("Vary") {
+		if strings.EqualFold(v, field) {
+			return
+		}
+	}
+	h.Add("Vary", field)
+}
+
+// negotiateFormat picks the response format. ?format= wins over Accept, and
+// JSON is used when neither says otherwise.
+func negotiateFormat(r *http.Request) (Format, error) {
+	if name := r.URL.Query().Get("format"); name != "" {
+		if name == "yml" {
+			name = "yaml"
+		}
+		for _, f := range FORMATS {
+			if f.Name == name {
+				return f, nil
+			}
+		}
+		return Format{}, fmt.Errorf("unknown format %q, use one of %s", name, strings.Join(formatNames(), ", "))
+	}
+
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return FORMAT_JSON, nil
+	}
+	for _, ar := range parseAccept(accept) {
+		if ar.mediaType == "*/*" || ar.mediaType == "application/*" {
+			return FORMAT_JSON, nil
+		}
+		for _, f := range FORMATS {
+			for _, mt := range f.MediaTypes {
+				if mt == ar.mediaType || ar.mediaType == strings.Split(mt, "/")[0]+"/*" {
+					return f, nil
+				}
+			}
+		}
+	}
+	return Format{}, fmt.Errorf("none of the accepted types are available, use one of %s", strings.Join(formatNames(), ", "))
+}
+
+// RowWriter writes a response one row at a time. single is set for
+// endpoints that look up one record, which JSON and YAML then write as an
+// object rather than a list.
+type RowWriter interface {
+	WriteRow(row interface{}) error
+	Close() error
+}
+
+// newRowWriter declares the content type and a 200 status, so it is only
+// called once the request can no longer fail as a whole.
+func newRowWriter(w http.ResponseWriter, format Format, single bool) RowWriter {
+	w.Header().Set("Content-Type", format.ContentType)
+	w.WriteHeader(http.StatusOK)
+	switch format.Name {
+	case "ndjson":
+		return &ndjsonWriter{json.NewEncoder(w)}
+	case "csv":
+		return &csvWriter{w: csv.NewWriter(w)}
+	case "yaml":
+		return &yamlWriter{w: w, single: single}
+	default:
+		return &jsonWriter{w: w, single: single}
+	}
+}
+
+// errSingleRow stops a second row from being appended to a single record,
+// which would no longer be one JSON or YAML document.
+var errSingleRow = errors.New("more than one row for a single record")
+
+type jsonWriter struct {
+	w      http.ResponseWriter
+	single bool
+	rows   int
+}
+
+func (jw *jsonWriter) WriteRow(row interface{}) error {
+	if jw.single && jw.rows > 0 {
+		return errSingleRow
+	}
+	data, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+	sep := ",\n"
+	if jw.rows == 0 {
+		sep = "[\n"
+	}
+	if jw.single {
+		sep = ""
+	}
+	jw.rows++
+	_, err = jw.w.Write(append([]byte(sep), data...))
+	return err
+}
+
+func (jw *jsonWriter) Close() error {
+	end := "\n]\n"
+	switch {
+	case jw.single:
+		end = "\n"
+	case jw.rows == 0:
+		end = "[]\n"
+	}
+	_, err := jw.w.Write([]byte(end))
+	return err
+}
+
+type ndjsonWriter struct {
+	enc *json.Encoder
+}
+
+func (nw *ndjsonWriter) WriteRow(row interface{}) error {
+	return nw.enc.Encode(row)
+}
+
+func (nw *ndjsonWriter) Close() error {
+	return nil
+}
+
+// plainValue round-trips v through JSON, so raw JSON columns and structs
+// become the maps, slices and float64s the other encoders understand.
+func plainValue(v interface{}) (interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var plain interface{}
+	err = json.Unmarshal(data, &plain)
+	return plain, err
+}
+
+// yamlWriter writes each row as an item of one top-level sequence, so rows
+// can be streamed without holding the whole list.
+type yamlWriter struct {
+	w      http.ResponseWriter
+	single bool
+	rows   int
+}
+
+func (yw *yamlWriter) WriteRow(row interface{}) error {
+	if yw.single && yw.rows > 0 {
+		return errSingleRow
+	}
+	plain, err := plainValue(row)
+	if err != nil {
+		return err
+	}
+	var doc interface{} = []interface{}{plain}
+	if yw.single {
+		doc = plain
+	}
+	data, err := yaml.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	yw.rows++
+	_, err = yw.w.Write(data)
+	return err
+}
+
+func (yw *yamlWriter) Close() error {
+	if yw.rows == 0 && !yw.single {
+		_, err := yw.w.Write([]byte("[]\n"))
+		return err
+	}
+	return nil
+}
+
+// csvWriter flattens nested fields into dotted column names, with array
+// elements numbered from 0 (e.g. armor_class.0.value). The header is the
+// union of every row's columns, so rows are held until Close.
+type csvWriter struct {
+	w       *csv.Writer
+	columns []string
+	seen    map[string]bool
+	rows    []map[string]string
+}
+
+func flatten(prefix string, v interface{}, out map[string]string, order *[]string) {
+	add := func(s string) {
+		*order = append(*order, prefix)
+		out[prefix] = s
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			flatten(joinPath(prefix, key), v[key], out, order)
+		}
+	case []interface{}:
+		for i, child := range v {
+			flatten(joinPath(prefix, strconv.Itoa(i)), child, out, order)
+		}
+	case nil:
+		add("")
+	case string:
+		add(v)
+	case float64:
+		add(strconv.FormatFloat(v, 'f', -1, 64))
+	default:
+		add(fmt.Sprint(v))
+	}
+}
+
+func (cw *csvWriter) WriteRow(row interface{}) error {
+	plain, err := plainValue(row)
+	if err != nil {
+		return err
+	}
+	if cw.seen == nil {
+		cw.seen = make(map[string]bool)
+	}
+
+	values := make(map[string]string)
+	var order []string
+	flatten("", plain, values, &order)
+	for _, col := range order {
+		if !cw.seen[col] {
+			cw.seen[col] = true
+			cw.columns = append(cw.columns, col)
+		}
+	}
+	cw.rows = append(cw.rows, values)
+	return nil
+}
+
+func (cw *csvWriter) Close() error {
+	if len(cw.rows) == 0 {
+		return nil
+	}
+	if err := cw.w.Write(cw.columns); err != nil {
+		return err
+	}
+	record := make([]string, len(cw.columns))
+	for _, row := range cw.rows {
+		for i, col := range cw.columns {
+			record[i] = row[col]
+		}
+		if err := cw.w.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.w.Flush()
+	return cw.w.Error()
+}
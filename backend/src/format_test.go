@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/csv"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestNegotiateFormat(t *testing.T) {
+	tests := []struct {
+		query  string
+		accept string
+		want   string
+	}{
+		{"", "", "json"},
+		{"", "*/*", "json"},
+		{"", "application/x-ndjson", "ndjson"},
+		{"", "text/html, text/csv;q=0.9, application/json;q=0.5", "csv"},
+		{"", "application/json;q=0.5, application/yaml", "yaml"},
+		{"?format=yml", "application/json", "yaml"},
+		{"?format=ndjson", "", "ndjson"},
+		{"", "text/html", ""},
+		{"?format=xml", "", ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/all/spells"+tt.query, nil)
+		if tt.accept != "" {
+			r.Header.Set("Accept", tt.accept)
+		}
+		format, err := negotiateFormat(r)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%s %s: expected an error, got %s", tt.query, tt.accept, format.Name)
+			}
+		} else if err != nil || format.Name != tt.want {
+			t.Errorf("%s %s: expected %s, got %s (%v)", tt.query, tt.accept, tt.want, format.Name, err)
+		}
+	}
+}
+
+func TestCsvWriterFlattens(t *testing.T) {
+	w := httptest.NewRecorder()
+	out := newRowWriter(w, FORMAT_CSV, false)
+	out.WriteRow(map[string]interface{}{
+		"name":        "Aboleth",
+		"armor_class": []interface{}{map[string]interface{}{"type": "natural", "value": 17}},
+	})
+	out.WriteRow(map[string]interface{}{"name": "Acolyte", "hit_points": 9})
+	if err := out.Close(); err != nil {
+		t.Fatalf("Failed to write CSV: %v", err)
+	}
+
+	records, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("Failed to read CSV: %v", err)
+	}
+	want := [][]string{
+		{"armor_class.0.type", "armor_class.0.value", "name", "hit_points"},
+		{"natural", "17", "Aboleth", ""},
+		{"", "", "Acolyte", "9"},
+	}
+	if len(records) != len(want) {
+		t.Fatalf("Expected %v, got %v", want, records)
+	}
+	for i := range want {
+		if strings.Join(records[i], ",") != strings.Join(want[i], ",") {
+			t.Errorf("Row %d: expected %v, got %v", i, want[i], records[i])
+		}
+	}
+}
+
+func TestSqliteFormats(t *testing.T) {
+	srv := newSqliteTestServer(t)
+
+	tests := []struct {
+		path        string
+		accept      string
+		contentType string
+	}{
+		{"/all/spells?limit=5", "", "application/json"},
+		{"/all/spells?limit=5", "application/x-ndjson", "application/x-ndjson"},
+		{"/all/spells?limit=5&format=csv", "", "text/csv; charset=utf-8"},
+		{"/v1/spells/fireball", "application/yaml", "application/yaml"},
+	}
+	bodies := make(map[string]string)
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", srv.URL+tt.path, nil)
+		if tt.accept != "" {
+			req.Header.Set("Accept", tt.accept)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatalf("Failed to read response body: %v", err)
+		}
+		contentType := res.Header.Get("Content-Type")
+		if res.StatusCode != http.StatusOK || contentType != tt.contentType {
+			t.Errorf("%s (%s): expected 200 %s, got %d %s", tt.path, tt.accept, tt.contentType, res.StatusCode, contentType)
+		}
+		bodies[tt.contentType] = string(body)
+	}
+
+	if lines := strings.Split(strings.TrimSpace(bodies["application/x-ndjson"]), "\n"); len(lines) != 5 {
+		t.Errorf("Expected 5 NDJSON lines, got %d", len(lines))
+	}
+
+	records, err := csv.NewReader(strings.NewReader(bodies["text/csv; charset=utf-8"])).ReadAll()
+	if err != nil || len(records) != 6 {
+		t.Errorf("Expected a header and 5 CSV rows, got %d (%v)", len(records), err)
+	} else if !strings.Contains(strings.Join(records[0], ","), "school.index") {
+		t.Errorf("Expected flattened columns, got %v", records[0])
+	}
+
+	var spell map[string]interface{}
+	if err := yaml.Unmarshal([]byte(bodies["application/yaml"]), &spell); err != nil || spell["index"] != "fireball" {
+		t.Errorf("Expected the fireball record as YAML, got %v (%v)", spell, err)
+	}
+
+	req, _ := http.NewRequest("GET", srv.URL+"/all/spells", nil)
+	req.Header.Set("Accept", "text/html")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotAcceptable {
+		t.Errorf("Expected status 406, got %d", res.StatusCode)
+	}
+}
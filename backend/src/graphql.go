@@ -0,0 +1,547 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/graphql-go/graphql"
+	"github.com/sirupsen/logrus"
+)
+
+var graphqlNamePattern = regexp.MustCompile(`^[_A-Za-z][_0-9A-Za-z]*$`)
+
+func validGraphQLName(name string) bool {
+	return graphqlNamePattern.MatchString(name) && !strings.HasPrefix(name, "__")
+}
+
+// pascalCase turns "magic_items" into "MagicItems".
+func pascalCase(s string) string {
+	var b strings.Builder
+	for _, word := range strings.FieldsFunc(s, func(c rune) bool {
+		return c == '_' || c == '-' || c == ' '
+	}) {
+		b.WriteString(strings.ToUpper(word[:1]) + word[1:])
+	}
+	return b.String()
+}
+
+// jsonScalar is the type of fields whose shape varies between rows, or whose
+// keys aren't GraphQL names, such as damage by slot level.
+var jsonScalar = graphql.NewScalar(graphql.ScalarConfig{
+	Name:        "JSON",
+	Description: "Any JSON value.",
+	Serialize:   func(value interface{}) interface{} { return value },
+})
+
+// referenceObject is the type of references to rows that aren't imported.
+var referenceObject = graphql.NewObject(graphql.ObjectConfig{
+	Name:        "Reference",
+	Description: "A link to a row that isn't in any table.",
+	Fields: graphql.Fields{
+		"index": &graphql.Field{Type: graphql.String},
+		"name":  &graphql.Field{Type: graphql.String},
+		"url":   &graphql.Field{Type: graphql.String},
+	},
+})
+
+type loaderKey struct{}
+
+// referenceLoader batches the rows behind references for one request. Each
+// resolver queues its urls and returns a thunk, and graphql-go runs thunks a
+// level of the response at a time, so the first thunk of a level that needs a
+// url still pending fetches every pending url with one query per table.
+type referenceLoader struct {
+	dbc     DbClient
+	pending []string
+	queued  map[string]bool
+	fetched map[string]bool
+	rows    map[string]map[string]interface{}
+	tables  map[string]string
+	queries int
+}
+
+func newReferenceLoader(dbc DbClient) *referenceLoader {
+	return &referenceLoader{
+		dbc:     dbc,
+		queued:  make(map[string]bool),
+		fetched: make(map[string]bool),
+		rows:    make(map[string]map[string]interface{}),
+		tables:  make(map[string]string),
+	}
+}
+
+func (l *referenceLoader) queue(u string) {
+	if !l.queued[u] {
+		l.queued[u] = true
+		l.pending = append(l.pending, u)
+	}
+}
+
+func (l *referenceLoader) flush() error {
+	urls := l.pending
+	l.pending = nil
+	for _, u := range urls {
+		l.fetched[u] = true
+	}
+	for table, params := range referenceTables(urls) {
+		l.queries++
+		rows, err := l.dbc.fetchUrls(table, params)
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			if u, ok := row["url"].(string); ok {
+				l.rows[u] = row
+				l.tables[u] = table
+			}
+		}
+	}
+	return nil
+}
+
+// queueReferences queues the urls of v, a reference or a list of them.
+func (l *referenceLoader) queueReferences(v interface{}) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if u, ok := isReference(v); ok {
+			l.queue(u)
+		}
+	case []interface{}:
+		for _, item := range v {
+			l.queueReferences(item)
+		}
+	}
+}
+
+// resolveReferences replaces each reference in v with the row it links to,
+// keeping the reference itself when there is no such row.
+func (l *referenceLoader) resolveReferences(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		u, ok := isReference(v)
+		if !ok {
+			return v, nil
+		}
+		if !l.fetched[u] {
+			if err := l.flush(); err != nil {
+				return nil, err
+			}
+		}
+		if row, ok := l.rows[u]; ok {
+			return row, nil
+		}
+		return v, nil
+	case []interface{}:
+		resolved := make([]interface{}, len(v))
+		for i, item := range v {
+			r, err := l.resolveReferences(item)
+			if err != nil {
+				return nil, err
+			}
+			resolved[i] = r
+		}
+		return resolved, nil
+	}
+	return v, nil
+}
+
+func valueResolver(key string) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		source, _ := p.Source.(map[string]interface{})
+		// Postgres NUMERIC columns, which graphql-go can't serialize.
+		if n, ok := source[key].(json.Number); ok {
+			return n.Float64()
+		}
+		return source[key], nil
+	}
+}
+
+func referenceResolver(key string) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		source, _ := p.Source.(map[string]interface{})
+		value := source[key]
+		loader := p.Context.Value(loaderKey{}).(*referenceLoader)
+		loader.queueReferences(value)
+		return func() (interface{}, error) {
+			return loader.resolveReferences(value)
+		}, nil
+	}
+}
+
+// graphqlBuilder makes an object type for each table from its mapping, with
+// nested fields typed from the schema inferred from its rows. References
+// become fields of the type of the table they link to.
+type graphqlBuilder struct {
+	schemas map[string]map[string]interface{}
+	tables  map[string]*graphql.Object
+	unions  map[string]*graphql.Union
+	names   map[string]int
+}
+
+// typeName makes names unique, which nested object names built from their
+// parent's name and field could in theory not be.
+func (b *graphqlBuilder) typeName(name string) string {
+	b.names[name]++
+	if n := b.names[name]; n > 1 {
+		return name + strconv.Itoa(n)
+	}
+	return name
+}
+
+func (b *graphqlBuilder) tableObject(table string) *graphql.Object {
+	name := b.typeName(pascalCase(table))
+	return graphql.NewObject(graphql.ObjectConfig{
+		Name:        name,
+		Description: "A row of " + table + ".",
+		Fields: graphql.FieldsThunk(func() graphql.Fields {
+			t := TABLES[table]
+			inferred, _ := b.schemas[table]["properties"].(map[string]interface{})
+			fields := graphql.Fields{}
+			for _, key := range t.Mapping {
+				if !validGraphQLName(key) {
+					continue
+				}
+				schema, ok := inferred[key].(map[string]interface{})
+				if !ok {
+					schema = columnSchema(t.Types[key])
+				}
+				fields[key] = b.field(name, key, schema)
+			}
+			return fields
+		}),
+	})
+}
+
+func (b *graphqlBuilder) field(parent string, key string, schema map[string]interface{}) *graphql.Field {
+	t, references := b.outputType(parent+pascalCase(key), schema)
+	field := &graphql.Field{Type: t, Resolve: valueResolver(key)}
+	if references {
+		field.Resolve = referenceResolver(key)
+	}
+	if description, ok := schema["description"].(string); ok {
+		field.Description = description
+	}
+	return field
+}
+
+// outputType is the GraphQL type of a JSON Schema from inferSchema, and
+// whether its values are references, or lists of them, to be loaded.
+func (b *graphqlBuilder) outputType(name string, schema map[string]interface{}) (graphql.Output, bool) {
+	if _, ok := schema["$ref"]; ok {
+		tables, _ := schema["x-tables"].([]string)
+		return b.referenceType(tables), true
+	}
+
+	var kinds []string
+	switch t := schema["type"].(type) {
+	case string:
+		kinds = []string{t}
+	case []string:
+		for _, kind := range t {
+			if kind != "null" {
+				kinds = append(kinds, kind)
+			}
+		}
+	}
+	if len(kinds) != 1 {
+		return jsonScalar, false
+	}
+
+	switch kinds[0] {
+	case "string":
+		return graphql.String, false
+	case "integer":
+		return graphql.Int, false
+	case "number":
+		return graphql.Float, false
+	case "boolean":
+		return graphql.Boolean, false
+	case "array":
+		items, ok := schema["items"].(map[string]interface{})
+		if !ok {
+			return graphql.NewList(jsonScalar), false
+		}
+		t, references := b.outputType(name, items)
+		return graphql.NewList(t), references
+	case "object":
+		return b.objectType(name, schema), false
+	}
+	return jsonScalar, false
+}
+
+func (b *graphqlBuilder) objectType(name string, schema map[string]interface{}) graphql.Output {
+	properties, _ := schema["properties"].(map[string]interface{})
+	if len(properties) == 0 {
+		return jsonScalar
+	}
+	for key := range properties {
+		if !validGraphQLName(key) {
+			return jsonScalar
+		}
+	}
+
+	name = b.typeName(name)
+	fields := graphql.Fields{}
+	for key, prop := range properties {
+		fields[key] = b.field(name, key, prop.(map[string]interface{}))
+	}
+	return graphql.NewObject(graphql.ObjectConfig{Name: name, Fields: fields})
+}
+
+// referenceType is the type of the table a reference links to, or a union
+// when rows of more than one table have urls of that shape.
+func (b *graphqlBuilder) referenceType(tables []string) graphql.Output {
+	var objects []*graphql.Object
+	var names []string
+	for _, table := range tables {
+		if obj, ok := b.tables[table]; ok {
+			objects = append(objects, obj)
+			names = append(names, obj.Name())
+		}
+	}
+	switch len(objects) {
+	case 0:
+		return referenceObject
+	case 1:
+		return objects[0]
+	}
+
+	name := strings.Join(names, "Or")
+	if union, ok := b.unions[name]; ok {
+		return union
+	}
+	union := graphql.NewUnion(graphql.UnionConfig{
+		Name:  name,
+		Types: objects,
+		ResolveType: func(p graphql.ResolveTypeParams) *graphql.Object {
+			row, _ := p.Value.(map[string]interface{})
+			u, _ := row["url"].(string)
+			loader := p.Context.Value(loaderKey{}).(*referenceLoader)
+			if table, ok := loader.tables[u]; ok {
+				return b.tables[table]
+			}
+			// Not found, so any of them will do for its index, name and url.
+			return objects[0]
+		},
+	})
+	b.unions[name] = union
+	return union
+}
+
+func (dbc DbClient) graphqlLookup(table string) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		var query string
+		var param interface{}
+		if index, ok := p.Args["index"].(string); ok {
+			query = fmt.Sprintf("SELECT * FROM %s WHERE _index = $1", table)
+			param = index
+		} else if name, ok := p.Args["name"].(string); ok {
+			query = nameQuery(table)
+			param = name
+		} else {
+			return nil, fmt.Errorf("index or name is required")
+		}
+
+		rows, err := dbc.queryMapsCached(table, query, param)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"table":  table,
+				"method": "graphql",
+			}).WithError(err).Warn("Failed to query database")
+			return nil, fmt.Errorf("failed to query database")
+		}
+		if len(rows) == 0 {
+			return nil, nil
+		}
+		return rows[0], nil
+	}
+}
+
+func (dbc DbClient) graphqlList(table string) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		query := url.Values{}
+		if filter, ok := p.Args["filter"].(string); ok {
+			query.Set("filter", filter)
+		}
+		if sort, ok := p.Args["sort"].(string); ok {
+			query.Set("sort", sort)
+		}
+		if limit, ok := p.Args["limit"].(int); ok {
+			query.Set("limit", strconv.Itoa(limit))
+		}
+		opts, err := parseListOptions(TABLES[table], dbc.Dialect(), query, nil)
+		if err != nil {
+			return nil, err
+		}
+		if offset, ok := p.Args["offset"].(int); ok {
+			if offset < 0 || !opts.paged() {
+				return nil, fmt.Errorf("offset must be at least 0 and needs a limit")
+			}
+			opts.Offset = offset
+		}
+
+		rows, err := dbc.queryMapsCached(table, opts.selectQuery(table), opts.Params...)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"table":  table,
+				"method": "graphql",
+			}).WithError(err).Warn("Failed to query database")
+			return nil, fmt.Errorf("failed to query database")
+		}
+		return rows, nil
+	}
+}
+
+func (dbc DbClient) buildGraphQLSchema() (*graphql.Schema, error) {
+	b := &graphqlBuilder{
+		schemas: make(map[string]map[string]interface{}, len(TABLES)),
+		tables:  make(map[string]*graphql.Object, len(TABLES)),
+		unions:  make(map[string]*graphql.Union),
+		names:   map[string]int{"Query": 1, "JSON": 1, "Reference": 1},
+	}
+	for _, table := range TABLE_NAMES {
+		schema, err := dbc.inferredSchema(table)
+		if err != nil {
+			return nil, err
+		}
+		b.schemas[table] = schema
+		b.tables[table] = b.tableObject(table)
+	}
+
+	fields := graphql.Fields{}
+	for _, table := range TABLE_NAMES {
+		fields[table] = &graphql.Field{
+			Type:        b.tables[table],
+			Description: "Looks up a row of " + table + " by index, or by name ignoring case.",
+			Args: graphql.FieldConfigArgument{
+				"index": &graphql.ArgumentConfig{Type: graphql.String},
+				"name":  &graphql.ArgumentConfig{Type: graphql.String},
+			},
+			Resolve: dbc.graphqlLookup(table),
+		}
+		fields["all_"+table] = &graphql.Field{
+			Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(b.tables[table]))),
+			Description: "Lists the rows of " + table + ", as /all/" + table + " does.",
+			Args: graphql.FieldConfigArgument{
+				"filter": &graphql.ArgumentConfig{Type: graphql.String},
+				"sort":   &graphql.ArgumentConfig{Type: graphql.String},
+				"limit":  &graphql.ArgumentConfig{Type: graphql.Int},
+				"offset": &graphql.ArgumentConfig{Type: graphql.Int},
+			},
+			Resolve: dbc.graphqlList(table),
+		}
+	}
+
+	schema, err := graphql.NewSchema(graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{Name: "Query", Fields: fields}),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &schema, nil
+}
+
+// The GraphQL schema is built on first request and dropped on import, as
+// the schemas it is built from are.
+var (
+	graphqlMu     sync.Mutex
+	graphqlSchema *graphql.Schema
+)
+
+func forgetGraphQLSchema() {
+	graphqlMu.Lock()
+	defer graphqlMu.Unlock()
+	graphqlSchema = nil
+}
+
+func (dbc DbClient) currentGraphQLSchema() (*graphql.Schema, error) {
+	graphqlMu.Lock()
+	defer graphqlMu.Unlock()
+	if graphqlSchema != nil {
+		return graphqlSchema, nil
+	}
+
+	schema, err := dbc.buildGraphQLSchema()
+	if err != nil {
+		return nil, err
+	}
+	graphqlSchema = schema
+	return graphqlSchema, nil
+}
+
+type GraphQLRequest struct {
+	Query         string                 `json:"query"`
+	Variables     map[string]interface{} `json:"variables"`
+	OperationName string                 `json:"operationName"`
+}
+
+// runGraphQL executes a request with a fresh referenceLoader, returning how
+// many reference queries it took.
+func (dbc DbClient) runGraphQL(ctx context.Context, req GraphQLRequest) (*graphql.Result, int, error) {
+	schema, err := dbc.currentGraphQLSchema()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	loader := newReferenceLoader(dbc)
+	result := graphql.Do(graphql.Params{
+		Schema:         *schema,
+		RequestString:  req.Query,
+		VariableValues: req.Variables,
+		OperationName:  req.OperationName,
+		Context:        context.WithValue(ctx, loaderKey{}, loader),
+	})
+	return result, loader.queries, nil
+}
+
+func (dbc DbClient) graphqlHandler(w http.ResponseWriter, r *http.Request) {
+	log := logrus.WithFields(logrus.Fields{
+		"method": "graphql",
+		"ip":     r.RemoteAddr,
+	})
+	log.Debug("Received GraphQL request")
+
+	var req GraphQLRequest
+	if r.Method == http.MethodGet {
+		query := r.URL.Query()
+		req.Query = query.Get("query")
+		req.OperationName = query.Get("operationName")
+		if v := query.Get("variables"); v != "" {
+			if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+				log.WithError(err).Warn("Invalid variables")
+				writeInvalidParameter(w, r, paramError("variables", "Invalid variables"))
+				return
+			}
+		}
+	} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.WithError(err).Warn("Invalid GraphQL request")
+		writeError(w, r, http.StatusBadRequest, ERR_INVALID_BODY, "Invalid GraphQL request", nil)
+		return
+	}
+	if req.Query == "" {
+		log.Warn("Missing query")
+		writeInvalidParameter(w, r, paramError("query", "Missing query"))
+		return
+	}
+
+	result, queries, err := dbc.runGraphQL(r.Context(), req)
+	if err != nil {
+		log.WithError(err).Warn("Failed to build GraphQL schema")
+		writeInternalError(w, r, "Failed to build GraphQL schema")
+		return
+	}
+
+	log.WithFields(logrus.Fields{
+		"errors":            len(result.Errors),
+		"reference_queries": queries,
+	}).Info("Finished query")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestSqliteGraphQL(t *testing.T) {
+	srv := newSqliteTestServer(t)
+
+	body, _ := json.Marshal(GraphQLRequest{Query: `query ($spell: String) {
+		spells(index: $spell) {
+			name
+			level
+			school { name desc }
+			classes { index hit_die }
+		}
+		all_classes(sort: "name", limit: 2) { name }
+	}`, Variables: map[string]interface{}{"spell": "fireball"}})
+	res, err := http.Post(srv.URL+"/v1/graphql", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", res.StatusCode)
+	}
+
+	var result struct {
+		Data struct {
+			Spells struct {
+				Name    string
+				Level   int
+				School  struct{ Name, Desc string }
+				Classes []struct {
+					Index  string
+					HitDie int `json:"hit_die"`
+				}
+			}
+			AllClasses []struct{ Name string } `json:"all_classes"`
+		}
+		Errors []interface{}
+	}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		t.Fatalf("Failed to decode response body: %v", err)
+	}
+	if len(result.Errors) > 0 {
+		t.Fatalf("Expected no errors, got %v", result.Errors)
+	}
+
+	spell := result.Data.Spells
+	if spell.Name != "Fireball" || spell.Level != 3 {
+		t.Errorf("Expected Fireball, level 3, got %+v", spell)
+	}
+	if spell.School.Name != "Evocation" || spell.School.Desc == "" {
+		t.Errorf("Expected the school to be loaded, got %+v", spell.School)
+	}
+	if len(spell.Classes) == 0 || spell.Classes[0].HitDie == 0 {
+		t.Errorf("Expected the classes to be loaded, got %+v", spell.Classes)
+	}
+	if len(result.Data.AllClasses) != 2 || result.Data.AllClasses[0].Name != "Barbarian" {
+		t.Errorf("Expected the first two classes, got %+v", result.Data.AllClasses)
+	}
+}
+
+func TestSqliteGraphQLBatches(t *testing.T) {
+	db, err := getTestSqliteDb(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to get test database: %v", err)
+	}
+	defer db.Close()
+	if err := populate(db); err != nil {
+		t.Fatalf("Failed to populate database: %v", err)
+	}
+
+	// Every spell's school and classes, then the classes' spellcasting
+	// ability, is two levels of references whatever the number of spells.
+	result, queries, err := DbClient{db}.runGraphQL(context.Background(), GraphQLRequest{
+		Query: `{ all_spells { name school { name } classes { name spellcasting { spellcasting_ability { name } } } } }`,
+	})
+	if err != nil {
+		t.Fatalf("Failed to run query: %v", err)
+	}
+	if len(result.Errors) > 0 {
+		t.Fatalf("Expected no errors, got %v", result.Errors)
+	}
+	if queries > 4 {
+		t.Errorf("Expected references to be loaded a level at a time, took %d queries", queries)
+	}
+}
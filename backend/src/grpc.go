@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/AppalachianCoding/rpg-app/backend/srdpb"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const DEFAULT_RPC_PAGE_SIZE = 100
+
+// srdServer is the gRPC service of srdpb, over the same DbClient and caches
+// as the HTTP handlers.
+type srdServer struct {
+	srdpb.UnimplementedSrdServer
+	dbc DbClient
+}
+
+func stringField(row map[string]interface{}, key string) string {
+	s, _ := row[key].(string)
+	return s
+}
+
+func floatField(row map[string]interface{}, key string) float64 {
+	switch v := row[key].(type) {
+	case float64:
+		return v
+	case int64:
+		return float64(v)
+	case json.Number:
+		f, _ := v.Float64()
+		return f
+	case string:
+		f, _ := strconv.ParseFloat(v, 64)
+		return f
+	}
+	return 0
+}
+
+// newEntry converts a row by way of JSON, so data matches what the HTTP API
+// returns for it.
+func newEntry(table string, row map[string]interface{}) (*srdpb.Entry, error) {
+	b, err := json.Marshal(row)
+	if err != nil {
+		return nil, err
+	}
+	data := &structpb.Struct{}
+	if err := protojson.Unmarshal(b, data); err != nil {
+		return nil, err
+	}
+	return &srdpb.Entry{
+		Table: table,
+		Index: stringField(row, "index"),
+		Name:  stringField(row, "name"),
+		Url:   stringField(row, "url"),
+		Data:  data,
+	}, nil
+}
+
+func invalidTable(table string) error {
+	return status.Errorf(codes.InvalidArgument, "invalid table %q", table)
+}
+
+func queryFailed(table string, err error) error {
+	logrus.WithFields(logrus.Fields{
+		"table":  table,
+		"method": "grpc",
+	}).WithError(err).Warn("Failed to query database")
+	return status.Error(codes.Internal, "failed to query database")
+}
+
+func (s *srdServer) ListTables(ctx context.Context, req *srdpb.ListTablesRequest) (*srdpb.ListTablesResponse, error) {
+	resp := &srdpb.ListTablesResponse{}
+	for _, name := range TABLE_NAMES {
+		table := TABLES[name]
+		columns := make(map[string]string, len(table.Mapping))
+		for _, key := range table.Mapping {
+			columns[key] = table.Types[key]
+		}
+		resp.Tables = append(resp.Tables, &srdpb.Table{Name: name, Columns: columns})
+	}
+	return resp, nil
+}
+
+func (s *srdServer) GetEntry(ctx context.Context, req *srdpb.GetEntryRequest) (*srdpb.Entry, error) {
+	table := req.GetTable()
+	if !verifyTable(table) {
+		return nil, invalidTable(table)
+	}
+
+	// The same queries as lookupHandler and apiHandler, so they share
+	// ROW_CACHE entries.
+	var query string
+	var param interface{}
+	switch key := req.GetKey().(type) {
+	case *srdpb.GetEntryRequest_Index:
+		query = fmt.Sprintf("SELECT * FROM %s WHERE _index = $1", table)
+		param = key.Index
+	case *srdpb.GetEntryRequest_Name:
+		query = nameQuery(table)
+		param = key.Name
+	default:
+		return nil, status.Error(codes.InvalidArgument, "index or name is required")
+	}
+
+	rows, err := s.dbc.queryMapsCached(table, query, param)
+	if err != nil {
+		return nil, queryFailed(table, err)
+	}
+	if len(rows) == 0 {
+		return nil, status.Errorf(codes.NotFound, "no %s entry %q", table, param)
+	}
+	return newEntry(table, rows[0])
+}
+
+func (s *srdServer) ListEntries(ctx context.Context, req *srdpb.ListEntriesRequest) (*srdpb.ListEntriesResponse, error) {
+	table := req.GetTable()
+	if !verifyTable(table) {
+		return nil, invalidTable(table)
+	}
+
+	// A page token carries its page size, which page_size only overrides
+	// when it is set.
+	query := url.Values{}
+	if pageSize := req.GetPageSize(); pageSize != 0 {
+		query.Set("limit", strconv.Itoa(int(pageSize)))
+	} else if req.GetPageToken() == "" {
+		query.Set("limit", strconv.Itoa(DEFAULT_RPC_PAGE_SIZE))
+	}
+	if req.GetFilter() != "" {
+		query.Set("filter", req.GetFilter())
+	}
+	if req.GetSort() != "" {
+		query.Set("sort", req.GetSort())
+	}
+	if len(req.GetFields()) > 0 {
+		query.Set("fields", strings.Join(req.GetFields(), ","))
+	}
+	if req.GetPageToken() != "" {
+		query.Set("cursor", req.GetPageToken())
+	}
+
+	opts, err := parseListOptions(TABLES[table], s.dbc.Dialect(), query, nil)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	total, err := countRows(s.dbc.DB, table, opts.Where, opts.Params...)
+	if err != nil {
+		return nil, queryFailed(table, err)
+	}
+	rows, err := s.dbc.queryMapsCached(table, opts.selectQuery(table), opts.Params...)
+	if err != nil {
+		return nil, queryFailed(table, err)
+	}
+
+	resp := &srdpb.ListEntriesResponse{
+		NextPageToken: opts.nextCursor(total),
+		TotalCount:    int32(total),
+	}
+	for _, row := range rows {
+		entry, err := newEntry(table, row)
+		if err != nil {
+			return nil, err
+		}
+		resp.Entries = append(resp.Entries, entry)
+	}
+	return resp, nil
+}
+
+func (s *srdServer) Search(ctx context.Context, req *srdpb.SearchRequest) (*srdpb.SearchResponse, error) {
+	if !hasWord(req.GetQuery()) {
+		return nil, status.Error(codes.InvalidArgument, "query is required")
+	}
+	for _, table := range req.GetTables() {
+		if !verifyTable(table) {
+			return nil, invalidTable(table)
+		}
+	}
+	limit := int(req.GetLimit())
+	if limit == 0 {
+		limit = DEFAULT_SEARCH_LIMIT
+	}
+	if limit < 1 || limit > MAX_SEARCH_LIMIT {
+		return nil, status.Errorf(codes.InvalidArgument, "limit must be between 1 and %d", MAX_SEARCH_LIMIT)
+	}
+
+	query, params := s.dbc.searchQuery(req.GetQuery(), req.GetTables(), req.GetType(), limit)
+	rows, err := queryMaps(s.dbc.DB, query, params...)
+	if err != nil {
+		return nil, queryFailed(SEARCH_TABLE, err)
+	}
+
+	resp := &srdpb.SearchResponse{}
+	for _, row := range rows {
+		resp.Results = append(resp.Results, &srdpb.SearchResult{
+			Table:   stringField(row, "table"),
+			Index:   stringField(row, "index"),
+			Name:    stringField(row, "name"),
+			Url:     stringField(row, "url"),
+			Type:    stringField(row, "type"),
+			Rank:    floatField(row, "rank"),
+			Snippet: stringField(row, "snippet"),
+		})
+	}
+	return resp, nil
+}
+
+// logUnary logs each call the way the HTTP handlers log requests.
+func logUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+
+	fields := logrus.Fields{
+		"method":   info.FullMethod,
+		"code":     status.Code(err).String(),
+		"duration": time.Since(start),
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		fields["ip"] = p.Addr.String()
+	}
+	if err != nil {
+		logrus.WithFields(fields).WithError(err).Warn("Failed RPC")
+	} else {
+		logrus.WithFields(fields).Info("Finished RPC")
+	}
+	return resp, err
+}
+
+func newGrpcServer(dbClient DbClient) *grpc.Server {
+	srv := grpc.NewServer(grpc.UnaryInterceptor(logUnary))
+	srdpb.RegisterSrdServer(srv, &srdServer{dbc: dbClient})
+	// Lets tools such as grpcurl discover the service.
+	reflection.Register(srv)
+	return srv
+}
+
+// startGrpcServer serves the gRPC API next to the HTTP one from
+// startServer, sharing its DbClient.
+func startGrpcServer(dbClient DbClient, addr string) (*grpc.Server, error) {
+	logrus.Info("Starting gRPC server...")
+
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	srv := newGrpcServer(dbClient)
+
+	go func() {
+		log.Println("Starting gRPC server on", addr)
+		if err := srv.Serve(lis); err != nil {
+			logrus.Fatalf("gRPC server failed: %s\n", err)
+		}
+	}()
+
+	go func() {
+		quit := make(chan os.Signal, 1)
+		signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+		<-quit
+
+		log.Println("Shutting down gRPC server...")
+		srv.GracefulStop()
+	}()
+
+	return srv, nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/AppalachianCoding/rpg-app/backend/srdpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func newSqliteTestClient(t *testing.T) srdpb.SrdClient {
+	db, err := getTestSqliteDb(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to get test database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := populate(db); err != nil {
+		t.Fatalf("Failed to populate database: %v", err)
+	}
+
+	lis := bufconn.Listen(1 << 20)
+	srv := newGrpcServer(DbClient{db})
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return srdpb.NewSrdClient(conn)
+}
+
+func TestSqliteGrpc(t *testing.T) {
+	client := newSqliteTestClient(t)
+	ctx := context.Background()
+
+	tables, err := client.ListTables(ctx, &srdpb.ListTablesRequest{})
+	if err != nil {
+		t.Fatalf("Failed to list tables: %v", err)
+	}
+	if len(tables.Tables) != len(TABLE_NAMES) {
+		t.Errorf("Expected %d tables, got %d", len(TABLE_NAMES), len(tables.Tables))
+	}
+
+	entry, err := client.GetEntry(ctx, &srdpb.GetEntryRequest{
+		Table: "spells",
+		Key:   &srdpb.GetEntryRequest_Name{Name: "fireball"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to get entry: %v", err)
+	}
+	if entry.Index != "fireball" || entry.Data.Fields["level"].GetNumberValue() != 3 {
+		t.Errorf("Expected fireball, level 3, got %v", entry)
+	}
+
+	_, err = client.GetEntry(ctx, &srdpb.GetEntryRequest{
+		Table: "spells",
+		Key:   &srdpb.GetEntryRequest_Index{Index: "not-a-spell"},
+	})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("Expected NotFound, got %v", err)
+	}
+	_, err = client.GetEntry(ctx, &srdpb.GetEntryRequest{
+		Table: "not_a_table",
+		Key:   &srdpb.GetEntryRequest_Index{Index: "fireball"},
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument, got %v", err)
+	}
+
+	var names []string
+	req := &srdpb.ListEntriesRequest{Table: "spells", Filter: "level=9", Sort: "name", PageSize: 5}
+	for {
+		page, err := client.ListEntries(ctx, req)
+		if err != nil {
+			t.Fatalf("Failed to list entries: %v", err)
+		}
+		if len(page.Entries) > 5 {
+			t.Fatalf("Expected pages of at most 5, got %d", len(page.Entries))
+		}
+		for _, e := range page.Entries {
+			names = append(names, e.Name)
+		}
+		if page.NextPageToken == "" {
+			if int(page.TotalCount) != len(names) {
+				t.Errorf("Expected %d entries across pages, got %d", page.TotalCount, len(names))
+			}
+			break
+		}
+		// Later pages keep the size in the token.
+		req.PageToken = page.NextPageToken
+		req.PageSize = 0
+	}
+	if len(names) <= 5 || names[0] != "Astral Projection" {
+		t.Errorf("Expected several pages of 9th level spells, got %v", names)
+	}
+
+	results, err := client.Search(ctx, &srdpb.SearchRequest{Query: "fireball", Tables: []string{"spells"}})
+	if err != nil {
+		t.Fatalf("Failed to search: %v", err)
+	}
+	found := false
+	for _, r := range results.Results {
+		found = found || r.Index == "fireball" && r.Table == "spells"
+	}
+	if !found {
+		t.Errorf("Expected fireball in the results, got %v", results.Results)
+	}
+}
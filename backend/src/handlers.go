@@ -7,9 +7,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
-	"os"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
 )
@@ -23,10 +21,35 @@ func verifyTable(table string) bool {
 	return false
 }
 
+// decodeColumn turns a scanned value into something that encodes as the
+// original JSON, so nested objects come back as objects rather than strings.
+func decodeColumn(colType *sql.ColumnType, val interface{}) interface{} {
+	var b []byte
+	switch v := val.(type) {
+	case []byte:
+		b = v
+	case string:
+		// SQLite hands back JSON columns as plain strings.
+		b = []byte(v)
+	default:
+		return val
+	}
+	switch colType.DatabaseTypeName() {
+	case "JSONB", "JSON":
+		return json.RawMessage(b)
+	case "NUMERIC":
+		return json.Number(b)
+	default:
+		return string(b)
+	}
+}
+
 type DbClient struct {
 	*sql.DB
 }
 
+// QueryDb writes the rows a query returns as a list, in the format the
+// request asked for.
 func QueryDb(
 	w http.ResponseWriter,
 	r *http.Request,
@@ -34,6 +57,40 @@ func QueryDb(
 	log *logrus.Entry,
 	query string,
 	params ...interface{},
+) error {
+	return queryDb(w, r, db, log, false, query, params...)
+}
+
+// QueryDbRecord is QueryDb for lookups of a single record, which JSON and
+// YAML write as an object rather than a list.
+func QueryDbRecord(
+	w http.ResponseWriter,
+	r *http.Request,
+	db *sql.DB,
+	log *logrus.Entry,
+	query string,
+	params ...interface{},
+) error {
+	return queryDb(w, r, db, log, true, query, params...)
+}
+
+// notAcceptable reports that none of the formats the client will take can be
+// written. The error itself is always JSON.
+func notAcceptable(w http.ResponseWriter, r *http.Request, log *logrus.Entry, err error) {
+	log.WithError(err).Warn("Unsupported format")
+	writeError(w, r, http.StatusNotAcceptable, ERR_NOT_ACCEPTABLE, err.Error(), map[string]interface{}{
+		"formats": formatNames(),
+	})
+}
+
+func queryDb(
+	w http.ResponseWriter,
+	r *http.Request,
+	db *sql.DB,
+	log *logrus.Entry,
+	single bool,
+	query string,
+	params ...interface{},
 ) error {
 	log = log.WithFields(logrus.Fields{
 		"method": r.Method,
@@ -41,24 +98,31 @@ func QueryDb(
 		"query":  query,
 		"params": params,
 	})
+	addVary(w.Header(), "Accept")
+	format, err := negotiateFormat(r)
+	if err != nil {
+		notAcceptable(w, r, log, err)
+		return nil
+	}
+
 	rows, err := db.Query(query, params...)
 	if err != nil {
 		log.WithError(err).Warn("Failed to query database")
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("Failed to query database"))
+		writeInternalError(w, r, "Failed to query database")
 		return err
 	}
 	defer rows.Close()
 
-	w.WriteHeader(http.StatusOK)
-	w.Header().Set("Content-Type", "application/json")
-	enc := json.NewEncoder(w)
-
 	columns, err := rows.Columns()
 	if err != nil {
 		log.WithError(err).Warn("Failed to get columns")
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("Failed to get columns"))
+		writeInternalError(w, r, "Failed to get columns")
+		return err
+	}
+	colTypes, err := rows.ColumnTypes()
+	if err != nil {
+		log.WithError(err).Warn("Failed to get column types")
+		writeInternalError(w, r, "Failed to get column types")
 		return err
 	}
 	log.Debugf("Columns: %v\n", columns)
@@ -68,57 +132,71 @@ func QueryDb(
 		valuePtrs[i] = &values[i]
 	}
 
-	anyResults := false
-	for rows.Next() {
-		result := make(map[string]interface{})
+	// Look at the first row before writing anything, so the status code can
+	// still say whether a single record was found. Once rows are streaming
+	// the status is fixed, and later failures can only cut the response
+	// short. An empty listing is just an empty list.
+	more := rows.Next()
+	if !more {
+		if err := rows.Err(); err != nil {
+			log.WithError(err).Warn("Failed to read rows")
+			writeInternalError(w, r, "Failed to read rows")
+			return err
+		}
+		if single {
+			log.Warn("No results")
+			writeNoResults(w, r)
+			return nil
+		}
+	}
 
+	out := newRowWriter(w, format, single)
+	for ; more; more = rows.Next() {
 		if err := rows.Scan(valuePtrs...); err != nil {
 			log.WithError(err).Warn("Failed to scan row")
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte("Failed to scan row"))
 			return err
 		}
 
+		result := make(map[string]interface{}, len(columns))
 		for i, col := range columns {
-			col = convertToKey(col)
-			val := values[i]
-			if b, ok := val.([]byte); ok {
-				result[col] = string(b)
-			} else {
-				result[col] = val
-			}
+			result[convertToKey(col)] = decodeColumn(colTypes[i], values[i])
 		}
 
-		if len(result) == 0 {
-			log.Warn("No results")
-			w.WriteHeader(http.StatusNotFound)
-			w.Write([]byte("No results"))
-			continue
-		}
-
-		if err := enc.Encode(result); err != nil {
+		if err := out.WriteRow(result); err != nil {
 			log.WithError(err).Warn("Failed to encode result")
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte("Failed to encode result"))
 			return err
 		}
 
 		log.Tracef("Wrote %s", result)
-		anyResults = true
 	}
-
-	if !anyResults {
-		log.Warn("No results")
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte("No results"))
+	if err := rows.Err(); err != nil {
+		log.WithError(err).Warn("Failed to read rows")
+		return err
+	}
+	if err := out.Close(); err != nil {
+		log.WithError(err).Warn("Failed to encode result")
+		return err
 	}
 
 	log.Info("Finished query")
 	return nil
 }
 
-func newDbClient(ctx context.Context, cfg aws.Config, database string) (DbClient, error) {
-	db, err := connectToDb(ctx, cfg, os.Getenv("DB_SECRET"), database)
+func newDbClient(ctx context.Context, conf *Config) (DbClient, error) {
+	var db *sql.DB
+	var err error
+	switch {
+	case conf.Driver == "sqlite":
+		db, err = openSqlite(conf.Path)
+	case conf.DSN != "":
+		db, err = openPostgres(conf.DSN)
+	default:
+		var secrets SecretSource
+		secrets, err = conf.secretSource()
+		if err == nil {
+			db, err = connectToDb(ctx, conf, secrets, DND_DATABASE)
+		}
+	}
 	if err != nil {
 		logrus.Fatalf("Failed to connect to db: %s\n", err)
 	}
@@ -132,6 +210,13 @@ func newDbClient(ctx context.Context, cfg aws.Config, database string) (DbClient
 	return dbClient, nil
 }
 
+// nameQuery selects the record a display name refers to, ignoring case. Some
+// tables repeat names, such as levels and features, so the first by index
+// wins.
+func nameQuery(table string) string {
+	return fmt.Sprintf("SELECT * FROM %s WHERE lower(name) = lower($1) ORDER BY _index LIMIT 1", table)
+}
+
 func (dbc DbClient) apiHandler(w http.ResponseWriter, r *http.Request) {
 	db := dbc.DB
 	vars := mux.Vars(r)
@@ -147,13 +232,63 @@ func (dbc DbClient) apiHandler(w http.ResponseWriter, r *http.Request) {
 
 	if !verifyTable(table) {
 		log.Warnf("Invalid table %s\n", table)
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("Invalid table"))
+		writeInvalidTable(w, r, table)
+		return
+	}
+
+	sel, err := parseExpand(r.URL.Query())
+	if err != nil {
+		log.WithError(err).Warn("Invalid expand")
+		writeInvalidParameter(w, r, err)
+		return
 	}
 
-	query := fmt.Sprintf("SELECT * FROM %s WHERE name = $1", table)
+	query := nameQuery(table)
 	log = log.WithField("query", query)
-	if err := QueryDb(w, r, db, log, query, name); err != nil {
+	if sel != nil || ROW_CACHE != nil {
+		err = dbc.QueryDbMaps(w, r, log, table, sel, true, query, name)
+	} else {
+		err = QueryDbRecord(w, r, db, log, query, name)
+	}
+	if err != nil {
+		log.WithError(err).Warn("Failed to get data")
+	}
+}
+
+func (dbc DbClient) lookupHandler(w http.ResponseWriter, r *http.Request) {
+	db := dbc.DB
+	vars := mux.Vars(r)
+	table, _ := url.PathUnescape(vars["table"])
+	index, _ := url.PathUnescape(vars["index"])
+	log := logrus.WithFields(logrus.Fields{
+		"table":  table,
+		"index":  index,
+		"method": "lookup",
+		"ip":     r.RemoteAddr,
+	})
+	log.Debugf("Received request for %s from %s\n", index, table)
+
+	if !verifyTable(table) {
+		log.Warnf("Invalid table %s\n", table)
+		writeInvalidTable(w, r, table)
+		return
+	}
+
+	sel, err := parseExpand(r.URL.Query())
+	if err != nil {
+		log.WithError(err).Warn("Invalid expand")
+		writeInvalidParameter(w, r, err)
+		return
+	}
+
+	query := fmt.Sprintf("SELECT * FROM %s WHERE _index = $1", table)
+	log = log.WithField("query", query)
+	if sel != nil || ROW_CACHE != nil {
+		err = dbc.QueryDbMaps(w, r, log, table, sel, true, query, index)
+	} else {
+		err = QueryDbRecord(w, r, db, log, query, index)
+	}
+	if err != nil {
 		log.WithError(err).Warn("Failed to get data")
 	}
 }
@@ -171,13 +306,40 @@ func (dbc DbClient) allHandler(w http.ResponseWriter, r *http.Request) {
 
 	if !verifyTable(table) {
 		log.Warnf("Invalid table %s\n", table)
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("Invalid table"))
+		writeInvalidTable(w, r, table)
+		return
+	}
+
+	sel, err := parseExpand(r.URL.Query())
+	if err != nil {
+		log.WithError(err).Warn("Invalid expand")
+		writeInvalidParameter(w, r, err)
+		return
 	}
 
-	query := fmt.Sprintf("SELECT * FROM %s", table)
+	opts, err := parseListOptions(TABLES[table], dbc.Dialect(), r.URL.Query(), nil)
+	if err != nil {
+		log.WithError(err).Warn("Invalid list options")
+		writeInvalidParameter(w, r, err)
+		return
+	}
+
+	total, err := countRows(db, table, opts.Where, opts.Params...)
+	if err != nil {
+		log.WithError(err).Warn("Failed to count rows")
+		writeInternalError(w, r, "Failed to query database")
+		return
+	}
+	opts.setPageHeaders(w, r, total)
 
-	if err := QueryDb(w, r, db, log, query); err != nil {
+	query := opts.selectQuery(table)
+
+	if sel != nil || ROW_CACHE != nil {
+		err = dbc.QueryDbMaps(w, r, log, table, sel, false, query, opts.Params...)
+	} else {
+		err = QueryDb(w, r, db, log, query, opts.Params...)
+	}
+	if err != nil {
 		log.WithError(err).Warn("Failed to get all data")
 	}
 }
@@ -195,60 +357,50 @@ func (dbc DbClient) getAllNamesHandler(w http.ResponseWriter, r *http.Request) {
 
 	if !verifyTable(table) {
 		log.Warnf("Invalid table %s\n", table)
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("Invalid table"))
+		writeInvalidTable(w, r, table)
+		return
 	}
 
-	query := fmt.Sprintf("SELECT name FROM %s", table)
+	opts, err := parseListOptions(TABLES[table], dbc.Dialect(), r.URL.Query(), []string{"name"})
+	if err != nil {
+		log.WithError(err).Warn("Invalid list options")
+		writeInvalidParameter(w, r, err)
+		return
+	}
 
-	if err := QueryDb(w, r, db, log, query); err != nil {
-		log.WithError(err).Warn("Failed to get all names")
+	total, err := countRows(db, table, opts.Where, opts.Params...)
+	if err != nil {
+		log.WithError(err).Warn("Failed to count rows")
+		writeInternalError(w, r, "Failed to query database")
+		return
 	}
-}
+	opts.setPageHeaders(w, r, total)
+
+	query := opts.selectQuery(table)
 
-type APICapability struct {
-	Path        string   `json:"path"`
-	Methods     []string `json:"methods"`
-	Description string   `json:"description,omitempty"`
+	if ROW_CACHE != nil {
+		err = dbc.QueryDbMaps(w, r, log, table, nil, false, query, opts.Params...)
+	} else {
+		err = QueryDb(w, r, db, log, query, opts.Params...)
+	}
+	if err != nil {
+		log.WithError(err).Warn("Failed to get all names")
+	}
 }
 
-func capabilitiesHandler(w http.ResponseWriter, r *http.Request) {
-	logrus.WithFields(logrus.Fields{
-		"method": "capabilities",
+func (dbc DbClient) versionsHandler(w http.ResponseWriter, r *http.Request) {
+	log := logrus.WithFields(logrus.Fields{
+		"method": "versions",
 		"ip":     r.RemoteAddr,
-	}).Info("Received request for capabilities")
-	capabilities := []APICapability{
-		{
-			Path:    "/{table}/{name}",
-			Methods: []string{"POST"},
-			Description: "Handles API requests for a specific table and name. " +
-				"Used to insert or update data.",
-		},
-		{
-			Path:        "/{table}",
-			Methods:     []string{"GET"},
-			Description: "Retrieves all names for all records in a specified table.",
-		},
-		{
-			Path:        "/all/{table}",
-			Methods:     []string{"GET"},
-			Description: "Retrieves all records from a specified table.",
-		},
-		{
-			Path:    "/capabilities",
-			Methods: []string{"GET"},
-			Description: "Returns a list of all available API endpoints and their " +
-				"methods and descriptions.",
-		},
-		{
-			Path:        "/capabilities/{table}",
-			Methods:     []string{"GET"},
-			Description: "Returns the feilds of a table",
-		},
-	}
+	})
+	log.Debug("Received request for dataset versions")
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(capabilities)
+	query := "SELECT table_name AS \"table\", file, hash, schema_version, imported_at FROM " +
+		VERSIONS_TABLE + " ORDER BY table_name"
+
+	if err := QueryDb(w, r, dbc.DB, log, query); err != nil {
+		log.WithError(err).Warn("Failed to get dataset versions")
+	}
 }
 
 func tablesHandler(w http.ResponseWriter, r *http.Request) {
@@ -260,6 +412,15 @@ func tablesHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(TABLE_NAMES)
 }
 
+func driftHandler(w http.ResponseWriter, r *http.Request) {
+	logrus.WithFields(logrus.Fields{
+		"method": "drift",
+		"ip":     r.RemoteAddr,
+	}).Info("Received request for drift report")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(DRIFT_REPORTS)
+}
+
 func describeTable(w http.ResponseWriter, r *http.Request) {
 	log := logrus.WithFields(logrus.Fields{
 		"method": "describe",
@@ -270,15 +431,14 @@ func describeTable(w http.ResponseWriter, r *http.Request) {
 	log = log.WithField("table", t)
 	log.Debugf("Received request for table %s", t)
 
-	w.Header().Set("Content-Type", "application/json")
 	table, ok := TABLES[t]
 	if !ok {
-		log.Warnf("Table %s not found", t)
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte("Table not found"))
+		log.Warnf("Invalid table %s", t)
+		writeInvalidTable(w, r, t)
 		return
 	}
 	log.Debugf("Returning table %s", table)
+	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(table)
 }
 
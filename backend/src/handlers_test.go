@@ -5,10 +5,13 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"strconv"
 	"testing"
 
 	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
 )
 
 func TestApiHandler(t *testing.T) {
@@ -43,14 +46,13 @@ func TestApiHandler(t *testing.T) {
 			t.Fatalf("Expected status 200, got %d", namesRes.StatusCode)
 		}
 
-		dec := json.NewDecoder(namesRes.Body)
+		var lines []map[string]string
+		if err := json.NewDecoder(namesRes.Body).Decode(&lines); err != nil {
+			log.Errorf("Failed to decode response body: %v", err)
+			t.Fatalf("Failed to decode response body: %v", err)
+		}
 
-		for dec.More() {
-			var line map[string]string
-			if err := dec.Decode(&line); err != nil {
-				log.Errorf("Failed to decode response body: %v", err)
-				t.Fatalf("Failed to decode response body: %v", err)
-			}
+		for _, line := range lines {
 			name := line["name"]
 			log = log.WithField("name", name)
 			name = convertKey(name)
@@ -139,3 +141,245 @@ func TestAllHandler(t *testing.T) {
 
 	srv.Shutdown(nil)
 }
+
+func newSqliteTestServer(t *testing.T) *httptest.Server {
+	logrus.SetLevel(logrus.InfoLevel)
+
+	db, err := getTestSqliteDb(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to get test database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if err := populate(db); err != nil {
+		t.Fatalf("Failed to populate database: %v", err)
+	}
+
+	srv := httptest.NewServer(newRouter(DbClient{db}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestSqliteHandlers(t *testing.T) {
+	srv := newSqliteTestServer(t)
+
+	statuses := []struct {
+		method string
+		path   string
+		status int
+	}{
+		{"GET", "/v1/monsters/aboleth", http.StatusOK},
+		{"GET", "/v1/monsters/not-a-monster", http.StatusNotFound},
+		{"GET", "/v1/not_a_table/aboleth", http.StatusBadRequest},
+		{"GET", "/all/not_a_table", http.StatusBadRequest},
+		{"GET", "/not_a_table", http.StatusBadRequest},
+		{"POST", "/monsters/ABOLETH", http.StatusOK},
+		{"POST", "/monsters/Not%20A%20Monster", http.StatusNotFound},
+	}
+	for _, s := range statuses {
+		req, _ := http.NewRequest(s.method, srv.URL+s.path, nil)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		res.Body.Close()
+		if res.StatusCode != s.status {
+			t.Errorf("%s %s: expected status %d, got %d", s.method, s.path, s.status, res.StatusCode)
+		}
+	}
+
+	res, err := http.Post(srv.URL+"/monsters/Aboleth", "application/json", nil)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", res.StatusCode)
+	}
+
+	var monster map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&monster); err != nil {
+		t.Fatalf("Failed to decode response body: %v", err)
+	}
+	if _, ok := monster["armor_class"].([]interface{}); !ok {
+		t.Errorf("Expected armor_class to be an array, got %T", monster["armor_class"])
+	}
+	if _, ok := monster["hit_points"].(float64); !ok {
+		t.Errorf("Expected hit_points to be a number, got %T", monster["hit_points"])
+	}
+
+	res, err = http.Get(srv.URL + "/all/spells?expand=school")
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", res.StatusCode)
+	}
+
+	var spells []map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&spells); err != nil {
+		t.Fatalf("Failed to decode response body: %v", err)
+	}
+	school, ok := spells[0]["school"].(map[string]interface{})
+	if !ok || school["desc"] == nil {
+		t.Errorf("Expected school to be expanded, got %v", spells[0]["school"])
+	}
+}
+
+func TestSqlitePaging(t *testing.T) {
+	srv := newSqliteTestServer(t)
+
+	next := "/all/monsters?limit=100&sort=-challenge_rating&fields=index,name,challenge_rating"
+	seen := make(map[string]bool)
+	pages := 0
+	for next != "" {
+		res, err := http.Get(srv.URL + next)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", res.StatusCode)
+		}
+		if total := res.Header.Get("X-Total-Count"); total != "334" {
+			t.Errorf("Expected X-Total-Count 334, got %s", total)
+		}
+
+		last := 1000.0
+		var rows []map[string]interface{}
+		if err := json.NewDecoder(res.Body).Decode(&rows); err != nil {
+			t.Fatalf("Failed to decode response body: %v", err)
+		}
+		for _, row := range rows {
+			if len(row) != 3 {
+				t.Errorf("Expected 3 fields, got %v", row)
+			}
+			index := row["index"].(string)
+			if seen[index] {
+				t.Errorf("Monster %s returned twice", index)
+			}
+			seen[index] = true
+
+			cr := row["challenge_rating"].(float64)
+			if cr > last {
+				t.Errorf("Expected descending challenge ratings, got %v after %v", cr, last)
+			}
+			last = cr
+		}
+		res.Body.Close()
+
+		pages++
+		next = ""
+		if cursor := res.Header.Get("X-Next-Cursor"); cursor != "" {
+			next = "/all/monsters?sort=-challenge_rating&fields=index,name,challenge_rating&cursor=" + cursor
+		}
+	}
+
+	if pages != 4 {
+		t.Errorf("Expected 4 pages, got %d", pages)
+	}
+	if len(seen) != 334 {
+		t.Errorf("Expected 334 monsters, got %d", len(seen))
+	}
+
+	res, err := http.Get(srv.URL + "/all/monsters?fields=not_a_field")
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an unknown field, got %d", res.StatusCode)
+	}
+}
+
+func TestSqliteFilter(t *testing.T) {
+	srv := newSqliteTestServer(t)
+
+	paths := []string{
+		"/all/spells?filter=" + url.QueryEscape("level<=3 AND school.index=evocation"),
+		"/all/monsters?filter=" + url.QueryEscape("challenge_rating BETWEEN 1 AND 5"),
+		"/all/spells?filter=" + url.QueryEscape("classes.index=wizard"),
+		"/all/spells?filter=" + url.QueryEscape("name~fire AND NOT ritual=true"),
+	}
+	for _, path := range paths {
+		res, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("%s: expected status 200, got %d", path, res.StatusCode)
+		}
+		total, _ := strconv.Atoi(res.Header.Get("X-Total-Count"))
+		var rows []map[string]interface{}
+		if err := json.NewDecoder(res.Body).Decode(&rows); err != nil {
+			t.Fatalf("Failed to decode response body: %v", err)
+		}
+		res.Body.Close()
+		if len(rows) == 0 || len(rows) != total {
+			t.Errorf("%s: got %d rows with X-Total-Count %d", path, len(rows), total)
+		}
+	}
+
+	res, err := http.Get(srv.URL + "/all/spells?filter=" + url.QueryEscape("level <="))
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an invalid filter, got %d", res.StatusCode)
+	}
+}
+
+func TestSqliteEmptyListing(t *testing.T) {
+	srv := newSqliteTestServer(t)
+
+	none := "filter=" + url.QueryEscape("level>9")
+	past := "cursor=" + url.QueryEscape(encodeCursor(pageCursor{10000, 10}))
+	cases := []struct {
+		path  string
+		body  string
+		total bool
+	}{
+		{"/v1/all/spells?" + none, "[]\n", true},
+		{"/v1/all/spells?" + none + "&expand=school", "[]\n", true},
+		{"/v1/all/spells?" + none + "&format=yaml", "[]\n", true},
+		{"/v1/all/spells?" + none + "&format=ndjson", "", true},
+		{"/v1/spells?" + past, "[]\n", false},
+	}
+	for _, c := range cases {
+		res, err := http.Get(srv.URL + c.path)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK || string(body) != c.body {
+			t.Errorf("%s: expected 200 %q, got %d %q", c.path, c.body, res.StatusCode, body)
+		}
+		if total := res.Header.Get("X-Total-Count"); c.total && total != "0" {
+			t.Errorf("%s: expected X-Total-Count 0, got %q", c.path, total)
+		}
+	}
+}
+
+func TestSqliteDuplicateName(t *testing.T) {
+	srv := newSqliteTestServer(t)
+
+	for _, format := range []string{"json", "yaml"} {
+		res, err := http.Post(srv.URL+"/magic_items/Potion%20of%20Healing?format="+format, "application/json", nil)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		// Unmarshal rejects anything after the first document.
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		var item map[string]interface{}
+		if format == "yaml" {
+			err = yaml.Unmarshal(body, &item)
+		} else {
+			err = json.Unmarshal(body, &item)
+		}
+		if res.StatusCode != http.StatusOK || err != nil {
+			t.Fatalf("%s: Expected one record, got %d (%v)", format, res.StatusCode, err)
+		}
+		if item["index"] != "potion-of-healing" {
+			t.Errorf("%s: Expected the first match by index, got %v", format, item["index"])
+		}
+	}
+}
@@ -6,10 +6,10 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/gorilla/mux"
 	_ "github.com/lib/pq"
 	"github.com/sirupsen/logrus"
@@ -19,14 +19,19 @@ func main() {
 	logrus.SetLevel(logrus.TraceLevel)
 
 	ctx := context.Background()
-	cfg, err := config.LoadDefaultConfig(ctx)
+	conf, err := loadConfig(os.Args[1:])
 	if err != nil {
 		log.Fatalf("Failed to load config: %s\n", err)
 		return
 	}
-	logrus.Info("AWS config loaded")
+	logrus.WithField("driver", conf.Driver).Info("Config loaded")
 
-	dbClient, err := newDbClient(ctx, cfg, DND_DATABASE)
+	if conf.CacheMB > 0 {
+		ROW_CACHE = newRowCache(conf.CacheMB << 20)
+		logrus.WithField("mb", conf.CacheMB).Info("Row cache enabled")
+	}
+
+	dbClient, err := newDbClient(ctx, conf)
 	if err != nil {
 		log.Fatalf("Failed to create db client: %s\n", err)
 		return
@@ -34,32 +39,68 @@ func main() {
 	defer dbClient.DB.Close()
 	logrus.Info("DB client created")
 
-	srv := startServer(dbClient, ":80")
+	srv := startServer(dbClient, conf.Addr)
 	defer srv.Shutdown(ctx)
 	logrus.Info("Server started")
+
+	if conf.GrpcAddr != "" {
+		grpcSrv, err := startGrpcServer(dbClient, conf.GrpcAddr)
+		if err != nil {
+			log.Fatalf("Failed to start gRPC server: %s\n", err)
+			return
+		}
+		defer grpcSrv.GracefulStop()
+		logrus.Info("gRPC server started")
+	}
 	select {}
 }
 
-func startServer(dbClient DbClient, port string) *http.Server {
-	logrus.Info("Starting server...")
-
+func newRouter(dbClient DbClient) *mux.Router {
 	r := mux.NewRouter()
 	r.UseEncodedPath()
 
-	r.HandleFunc("/health", healthCheckHandler).Methods("GET")
-	r.HandleFunc("/tables", tablesHandler).Methods("GET")
-	r.HandleFunc("/capabilities", capabilitiesHandler).Methods("GET")
+	r.Use(requestID)
+	r.Use(compress)
+	// Middleware only runs on matched routes, so the fallbacks need their
+	// own request ID.
+	r.NotFoundHandler = requestID(http.HandlerFunc(noRouteHandler))
+	r.MethodNotAllowedHandler = requestID(http.HandlerFunc(methodNotAllowedHandler))
+
+	// The current API. Its fixed endpoints are registered before the {table}
+	// routes, which leave their names alone, and paths under it never fall
+	// through to the legacy routes.
+	v1 := r.PathPrefix(API_PREFIX).Subrouter()
+	v1.NotFoundHandler = r.NotFoundHandler
+	v1.MethodNotAllowedHandler = r.MethodNotAllowedHandler
+	for _, route := range apiRoutes() {
+		handle(v1, API_PREFIX, route, route.bind(dbClient))
+	}
+
+	// The routes that predate API_PREFIX, unversioned, until LEGACY_SUNSET.
+	// Newer endpoints are only served under API_PREFIX.
+	for _, route := range apiRoutes() {
+		if route.Legacy {
+			handle(r, "", route, deprecated(route.bind(dbClient)))
+		}
+	}
 
-	r.HandleFunc("/all/{table}", dbClient.allHandler).Methods("GET")
-	r.HandleFunc("/capabilities/{table}", describeTable).Methods("GET")
+	return r
+}
 
-	r.HandleFunc("/", healthCheckHandler).Methods("GET")
-	r.HandleFunc("/{table}/{name}", dbClient.apiHandler).Methods("POST")
-	r.HandleFunc("/{table}", dbClient.getAllNamesHandler).Methods("GET")
+// handle registers a route on r, whose paths start with prefix.
+func handle(r *mux.Router, prefix string, route APIRoute, h http.HandlerFunc) {
+	m := r.HandleFunc(route.Path, h).Methods(route.Methods...)
+	if strings.HasPrefix(route.Path, "/{table}") {
+		m.MatcherFunc(notReserved(prefix))
+	}
+}
+
+func startServer(dbClient DbClient, port string) *http.Server {
+	logrus.Info("Starting server...")
 
 	srv := &http.Server{
 		Addr:         port,
-		Handler:      r,
+		Handler:      newRouter(dbClient),
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 10 * time.Second,
 	}
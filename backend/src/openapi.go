@@ -0,0 +1,385 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const OPENAPI_VERSION = "3.0.3"
+
+func arraySchema(items map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{"type": "array", "items": items}
+}
+
+func refSchema(name string) map[string]interface{} {
+	return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+}
+
+// typeSchema is the JSON schema of a Go type as encoding/json writes it.
+func typeSchema(t reflect.Type) map[string]interface{} {
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return typeSchema(t.Elem())
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return arraySchema(typeSchema(t.Elem()))
+	case reflect.Map:
+		return map[string]interface{}{
+			"type":                 "object",
+			"additionalProperties": typeSchema(t.Elem()),
+		}
+	case reflect.Struct:
+		properties := make(map[string]interface{})
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			name := field.Name
+			if tag := strings.Split(field.Tag.Get("json"), ",")[0]; tag == "-" {
+				continue
+			} else if tag != "" {
+				name = tag
+			}
+			properties[name] = typeSchema(field.Type)
+		}
+		return map[string]interface{}{"type": "object", "properties": properties}
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+func structSchema(v interface{}) map[string]interface{} {
+	return typeSchema(reflect.TypeOf(v))
+}
+
+var searchResultSchema = map[string]interface{}{
+	"type": "object",
+	"properties": map[string]interface{}{
+		"table":   map[string]interface{}{"type": "string"},
+		"index":   map[string]interface{}{"type": "string"},
+		"name":    map[string]interface{}{"type": "string"},
+		"url":     map[string]interface{}{"type": "string"},
+		"type":    map[string]interface{}{"type": "string", "nullable": true},
+		"rank":    map[string]interface{}{"type": "number"},
+		"snippet": map[string]interface{}{"type": "string"},
+	},
+}
+
+var referencesSchema = map[string]interface{}{
+	"type": "object",
+	"properties": map[string]interface{}{
+		"table": map[string]interface{}{"type": "string"},
+		"index": map[string]interface{}{"type": "string"},
+		"url":   map[string]interface{}{"type": "string"},
+		"references": map[string]interface{}{
+			"type":        "object",
+			"description": "Referring rows, by table and then by field path.",
+			"additionalProperties": map[string]interface{}{
+				"type":                 "object",
+				"additionalProperties": arraySchema(structSchema(Backlink{})),
+			},
+		},
+	},
+}
+
+// columnSchema is the JSON schema of a column of one of the importer's types.
+func columnSchema(colType string) map[string]interface{} {
+	switch colType {
+	case INTEGER:
+		return map[string]interface{}{"type": "integer"}
+	case NUMERIC:
+		return map[string]interface{}{"type": "number"}
+	case BOOLEAN:
+		return map[string]interface{}{"type": "boolean"}
+	case TIMESTAMP:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case JSONB:
+		return map[string]interface{}{"description": "Nested JSON from the dataset."}
+	default:
+		return map[string]interface{}{"type": "string"}
+	}
+}
+
+// tableSchema describes a row of a table from its mapping and column types.
+// Every column but index may be missing, as listings can pick ?fields=.
+func tableSchema(table FiveETable) map[string]interface{} {
+	properties := make(map[string]interface{}, len(table.Mapping))
+	for _, key := range table.Mapping {
+		schema := columnSchema(table.Types[key])
+		schema["nullable"] = true
+		properties[key] = schema
+	}
+	return map[string]interface{}{"type": "object", "properties": properties}
+}
+
+var pathParamPattern = regexp.MustCompile(`\{([^}:]+)(:[^}]*)?\}`)
+
+// operationId names an operation after its method and path, e.g.
+// get_spells_by_index for GET /spells/{index}.
+func operationId(method string, path string) string {
+	words := []string{strings.ToLower(method)}
+	for _, segment := range strings.Split(path, "/") {
+		if segment == "" {
+			continue
+		}
+		if m := pathParamPattern.FindStringSubmatch(segment); m != nil {
+			words = append(words, "by", m[1])
+			continue
+		}
+		words = append(words, strings.Map(func(c rune) rune {
+			if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' {
+				return c
+			}
+			return '_'
+		}, segment))
+	}
+	if len(words) == 1 {
+		words = append(words, "root")
+	}
+	return strings.Join(words, "_")
+}
+
+func textContent() map[string]interface{} {
+	return map[string]interface{}{
+		"text/plain": map[string]interface{}{"schema": map[string]interface{}{"type": "string"}},
+	}
+}
+
+// negotiatedContent lists the formats rows can be written in. JSON and YAML
+// hold a list, or just the row for single lookups.
+func negotiatedContent(row map[string]interface{}, single bool) map[string]interface{} {
+	doc := arraySchema(row)
+	if single {
+		doc = row
+	}
+	return map[string]interface{}{
+		FORMAT_JSON.MediaTypes[0]:   map[string]interface{}{"schema": doc},
+		FORMAT_NDJSON.MediaTypes[0]: map[string]interface{}{"schema": row},
+		FORMAT_CSV.MediaTypes[0]:    map[string]interface{}{"schema": map[string]interface{}{"type": "string"}},
+		FORMAT_YAML.MediaTypes[0]:   map[string]interface{}{"schema": doc},
+	}
+}
+
+func (route APIRoute) operation(method string, path string, table string) map[string]interface{} {
+	var parameters []interface{}
+	for _, m := range pathParamPattern.FindAllStringSubmatch(path, -1) {
+		parameters = append(parameters, map[string]interface{}{
+			"name":     m[1],
+			"in":       "path",
+			"required": true,
+			"schema":   map[string]interface{}{"type": "string"},
+		})
+	}
+	for _, p := range route.Params {
+		parameters = append(parameters, map[string]interface{}{
+			"name":        p.Name,
+			"in":          "query",
+			"description": p.Description,
+			"schema":      map[string]interface{}{"type": p.Type},
+		})
+	}
+
+	ok := map[string]interface{}{"description": "OK"}
+	switch route.Response {
+	case RESPONSE_ROWS:
+		ok["content"] = negotiatedContent(refSchema(table), false)
+	case RESPONSE_RECORD:
+		ok["content"] = negotiatedContent(refSchema(table), true)
+	case RESPONSE_LIST:
+		ok["content"] = negotiatedContent(route.Schema, false)
+	case RESPONSE_JSON:
+		ok["content"] = map[string]interface{}{
+			"application/json": map[string]interface{}{"schema": route.Schema},
+		}
+	case RESPONSE_NONE:
+	default:
+		ok["content"] = textContent()
+	}
+	if route.Paged {
+		ok["headers"] = map[string]interface{}{
+			"X-Total-Count": map[string]interface{}{
+				"description": "Rows matching the request across all pages.",
+				"schema":      map[string]interface{}{"type": "integer"},
+			},
+			"X-Next-Cursor": map[string]interface{}{
+				"description": "The ?cursor= for the next page, if there is one.",
+				"schema":      map[string]interface{}{"type": "string"},
+			},
+		}
+	}
+
+	status := http.StatusOK
+	if route.Status != 0 {
+		status = route.Status
+	}
+	ok["description"] = http.StatusText(status)
+	responses := map[string]interface{}{strconv.Itoa(status): ok}
+	errorResponse := func(description string) map[string]interface{} {
+		return map[string]interface{}{
+			"description": description,
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{"schema": refSchema("Error")},
+			},
+		}
+	}
+	if len(parameters) > 0 || route.Body != nil {
+		responses["400"] = errorResponse("Invalid table, parameters or body.")
+	}
+	switch route.Response {
+	case RESPONSE_ROWS, RESPONSE_RECORD, RESPONSE_LIST:
+		responses["406"] = errorResponse("None of the accepted formats are available.")
+	}
+	// Listings are empty rather than missing, but paths naming something
+	// other than a table can name nothing.
+	for _, m := range pathParamPattern.FindAllStringSubmatch(path, -1) {
+		if m[1] != "table" {
+			responses["404"] = errorResponse("No results.")
+		}
+	}
+	responses["500"] = errorResponse("The database could not be read or written.")
+	if route.Conditional {
+		responses["304"] = map[string]interface{}{"description": "Not modified since the last import or deploy."}
+	}
+
+	op := map[string]interface{}{
+		"operationId": operationId(method, path),
+		"description": route.Description,
+		"responses":   responses,
+	}
+	if len(parameters) > 0 {
+		op["parameters"] = parameters
+	}
+	if route.Body != nil && method != "GET" {
+		op["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{"schema": route.Body},
+			},
+		}
+	}
+	if table != "" {
+		op["tags"] = []string{table}
+	}
+	return op
+}
+
+// openAPISpec describes the routes served under API_PREFIX. Paths over
+// {table} are written out for each table, so each gets its own row schema.
+func openAPISpec() map[string]interface{} {
+	paths := make(map[string]map[string]interface{})
+	addOperation := func(path string, method string, op map[string]interface{}) {
+		if paths[path] == nil {
+			paths[path] = make(map[string]interface{})
+		}
+		// Like the router, the first route for a path wins.
+		if _, ok := paths[path][strings.ToLower(method)]; !ok {
+			paths[path][strings.ToLower(method)] = op
+		}
+	}
+
+	for _, route := range apiRoutes() {
+		for _, method := range route.Methods {
+			if !strings.Contains(route.Path, "{table}") {
+				addOperation(route.Path, method, route.operation(method, route.Path, ""))
+				continue
+			}
+			for _, table := range TABLE_NAMES {
+				path := strings.ReplaceAll(route.Path, "{table}", table)
+				addOperation(path, method, route.operation(method, path, table))
+			}
+		}
+	}
+
+	schemas := make(map[string]interface{}, len(TABLES)+1)
+	for name, table := range TABLES {
+		schemas[name] = tableSchema(table)
+	}
+	schemas["Error"] = structSchema(ErrorEnvelope{})
+
+	tags := make([]interface{}, 0, len(TABLE_NAMES))
+	names := append([]string(nil), TABLE_NAMES...)
+	sort.Strings(names)
+	for _, name := range names {
+		tags = append(tags, map[string]interface{}{"name": name})
+	}
+
+	return map[string]interface{}{
+		"openapi": OPENAPI_VERSION,
+		"info": map[string]interface{}{
+			"title":       "D&D 5e SRD API",
+			"version":     "1",
+			"description": "The tables of the D&D 5th edition System Reference Document, dice rolls and saved characters.",
+		},
+		"servers":    []interface{}{map[string]interface{}{"url": API_PREFIX}},
+		"tags":       tags,
+		"paths":      paths,
+		"components": map[string]interface{}{"schemas": schemas},
+	}
+}
+
+// The encoded spec is built on first request and dropped on import, as the
+// tables it describes may have changed.
+var (
+	openAPIMu   sync.Mutex
+	openAPIJSON []byte
+)
+
+func forgetOpenAPISpec() {
+	openAPIMu.Lock()
+	defer openAPIMu.Unlock()
+	openAPIJSON = nil
+}
+
+func currentOpenAPISpec() ([]byte, error) {
+	openAPIMu.Lock()
+	defer openAPIMu.Unlock()
+	if openAPIJSON != nil {
+		return openAPIJSON, nil
+	}
+
+	data, err := json.Marshal(openAPISpec())
+	if err != nil {
+		return nil, err
+	}
+	openAPIJSON = append(data, '\n')
+	return openAPIJSON, nil
+}
+
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	log := logrus.WithFields(logrus.Fields{
+		"method": "openapi",
+		"ip":     r.RemoteAddr,
+	})
+	log.Info("Received request for OpenAPI spec")
+
+	spec, err := currentOpenAPISpec()
+	if err != nil {
+		log.WithError(err).Warn("Failed to build OpenAPI spec")
+		writeInternalError(w, r, "Failed to build OpenAPI spec")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(spec)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// refs lists every $ref in a decoded JSON document.
+func refs(v interface{}) []string {
+	var found []string
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			if s, ok := child.(string); ok && key == "$ref" {
+				found = append(found, s)
+			}
+			found = append(found, refs(child)...)
+		}
+	case []interface{}:
+		for _, child := range v {
+			found = append(found, refs(child)...)
+		}
+	}
+	return found
+}
+
+func TestSqliteOpenAPI(t *testing.T) {
+	srv := newSqliteTestServer(t)
+
+	res, err := http.Get(srv.URL + "/v1/openapi.json")
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", res.StatusCode)
+	}
+
+	var spec struct {
+		OpenAPI    string                            `json:"openapi"`
+		Paths      map[string]map[string]interface{} `json:"paths"`
+		Components struct {
+			Schemas map[string]map[string]interface{} `json:"schemas"`
+		} `json:"components"`
+	}
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("Failed to read response body: %v", err)
+	}
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		t.Fatalf("Failed to decode response body: %v", err)
+	}
+	json.Unmarshal(data, &spec)
+
+	if !strings.HasPrefix(spec.OpenAPI, "3.") {
+		t.Errorf("Expected an OpenAPI 3 document, got %q", spec.OpenAPI)
+	}
+
+	for _, route := range apiRoutes() {
+		path := strings.ReplaceAll(route.Path, "{table}", "spells")
+		for _, method := range route.Methods {
+			if _, ok := spec.Paths[path][strings.ToLower(method)]; !ok {
+				t.Errorf("Expected %s %s in the spec", method, path)
+			}
+		}
+	}
+	if _, ok := spec.Paths["/all/monsters"]["get"]; !ok {
+		t.Error("Expected a path per table")
+	}
+
+	for path, statuses := range map[string]map[string]string{
+		"/characters":      {"post": "201"},
+		"/characters/{id}": {"delete": "204", "get": "404"},
+	} {
+		for method, status := range statuses {
+			op, _ := spec.Paths[path][method].(map[string]interface{})
+			responses, _ := op["responses"].(map[string]interface{})
+			if responses[status] == nil {
+				t.Errorf("Expected %s %s to list a %s response, got %v", method, path, status, responses)
+			}
+		}
+	}
+
+	level, _ := spec.Components.Schemas["spells"]["properties"].(map[string]interface{})["level"].(map[string]interface{})
+	if level["type"] != "integer" {
+		t.Errorf("Expected spells.level to be an integer, got %v", level)
+	}
+
+	for _, ref := range refs(raw) {
+		name := strings.TrimPrefix(ref, "#/components/schemas/")
+		if _, ok := spec.Components.Schemas[name]; !ok {
+			t.Errorf("Unresolved reference %s", ref)
+		}
+	}
+
+	res, err = http.Get(srv.URL + "/capabilities")
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	defer res.Body.Close()
+	var capabilities []APICapability
+	if err := json.NewDecoder(res.Body).Decode(&capabilities); err != nil {
+		t.Fatalf("Failed to decode response body: %v", err)
+	}
+	if len(capabilities) != len(apiRoutes()) {
+		t.Errorf("Expected %d capabilities, got %d", len(apiRoutes()), len(capabilities))
+	}
+}
+
+func TestSqliteOpenAPIMatchesRouter(t *testing.T) {
+	newSqliteTestServer(t)
+	spec := openAPISpec()["paths"].(map[string]map[string]interface{})
+
+	err := newRouter(DbClient{}).Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		tpl, err := route.GetPathTemplate()
+		if err != nil || !strings.HasPrefix(tpl, API_PREFIX+"/") {
+			return nil
+		}
+		path := pathParamPattern.ReplaceAllString(strings.TrimPrefix(tpl, API_PREFIX), "{$1}")
+		methods, _ := route.GetMethods()
+		for _, method := range methods {
+			for _, table := range TABLE_NAMES {
+				p := strings.ReplaceAll(path, "{table}", table)
+				if _, ok := spec[p][strings.ToLower(method)]; !ok {
+					t.Errorf("Expected %s %s in the spec", method, p)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to walk routes: %v", err)
+	}
+}
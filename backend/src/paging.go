@@ -0,0 +1,208 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const MAX_PAGE_SIZE = 1000
+
+type SortKey struct {
+	Column string
+	Desc   bool
+}
+
+// ListOptions are the ?filter=, ?fields=, ?sort=, ?limit= and ?cursor=
+// parameters of the endpoints that list a table.
+type ListOptions struct {
+	Where  string
+	Params []interface{}
+	Fields []string
+	Sort   []SortKey
+	Limit  int
+	Offset int
+}
+
+// pageCursor is what an opaque ?cursor= decodes to. The data only changes on
+// re-import, so an offset is enough to resume from.
+type pageCursor struct {
+	Offset int `json:"o"`
+	Limit  int `json:"l"`
+}
+
+func encodeCursor(c pageCursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string) (pageCursor, error) {
+	var c pageCursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, fmt.Errorf("invalid cursor")
+	}
+	if err := json.Unmarshal(data, &c); err != nil || c.Offset < 0 || c.Limit < 1 {
+		return c, fmt.Errorf("invalid cursor")
+	}
+	return c, nil
+}
+
+func hasColumn(table FiveETable, column string) bool {
+	for _, key := range table.Mapping {
+		if key == column {
+			return true
+		}
+	}
+	return false
+}
+
+// parseListOptions reads the listing parameters, checking every column named
+// against the table's mapping. defaultFields is used when ?fields= is absent.
+func parseListOptions(table FiveETable, dialect Dialect, query url.Values, defaultFields []string) (*ListOptions, error) {
+	opts := &ListOptions{Fields: defaultFields}
+
+	if f := query.Get("filter"); f != "" {
+		where, params, err := compileFilter(table, dialect, f, 0)
+		if err != nil {
+			return nil, &ParamError{"filter", err}
+		}
+		opts.Where = where
+		opts.Params = params
+	}
+
+	if f := query.Get("fields"); f != "" {
+		opts.Fields = nil
+		for _, field := range strings.Split(f, ",") {
+			field = strings.TrimSpace(field)
+			if !hasColumn(table, field) {
+				return nil, paramError("fields", "unknown field %q", field)
+			}
+			opts.Fields = append(opts.Fields, field)
+		}
+	}
+
+	if s := query.Get("sort"); s != "" {
+		for _, key := range strings.Split(s, ",") {
+			key = strings.TrimSpace(key)
+			desc := strings.HasPrefix(key, "-")
+			key = strings.TrimPrefix(key, "-")
+			if !hasColumn(table, key) {
+				return nil, paramError("sort", "unknown sort field %q", key)
+			}
+			opts.Sort = append(opts.Sort, SortKey{key, desc})
+		}
+	}
+
+	if c := query.Get("cursor"); c != "" {
+		cursor, err := decodeCursor(c)
+		if err != nil {
+			return nil, &ParamError{"cursor", err}
+		}
+		opts.Offset = cursor.Offset
+		opts.Limit = cursor.Limit
+	}
+
+	if l := query.Get("limit"); l != "" {
+		limit, err := strconv.Atoi(l)
+		if err != nil || limit < 1 || limit > MAX_PAGE_SIZE {
+			return nil, paramError("limit", "limit must be between 1 and %d", MAX_PAGE_SIZE)
+		}
+		opts.Limit = limit
+	}
+
+	return opts, nil
+}
+
+func (opts *ListOptions) paged() bool {
+	return opts.Limit > 0
+}
+
+// selectQuery builds the SELECT for one page, to be run with opts.Params.
+func (opts *ListOptions) selectQuery(table string) string {
+	columns := "*"
+	if opts.Fields != nil {
+		cols := make([]string, len(opts.Fields))
+		for i, field := range opts.Fields {
+			cols[i] = convertKey(field)
+		}
+		columns = strings.Join(cols, ", ")
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM %s", columns, table)
+	if opts.Where != "" {
+		query += " WHERE " + opts.Where
+	}
+
+	// Pages need a stable order, so _index breaks any ties.
+	if len(opts.Sort) > 0 || opts.paged() {
+		order := make([]string, 0, len(opts.Sort)+1)
+		for _, key := range opts.Sort {
+			col := convertKey(key.Column)
+			if key.Desc {
+				order = append(order, col+" DESC")
+			} else {
+				order = append(order, col)
+			}
+		}
+		order = append(order, "_index")
+		query += " ORDER BY " + strings.Join(order, ", ")
+	}
+
+	if opts.paged() {
+		query += fmt.Sprintf(" LIMIT %d OFFSET %d", opts.Limit, opts.Offset)
+	}
+
+	return query
+}
+
+func countRows(db *sql.DB, table string, where string, params ...interface{}) (int, error) {
+	query := "SELECT count(*) FROM " + table
+	if where != "" {
+		query += " WHERE " + where
+	}
+
+	key := newCacheKey(table, query, params)
+	if total, ok := ROW_CACHE.get(key); ok {
+		return total.(int), nil
+	}
+
+	var total int
+	if err := db.QueryRow(query, params...).Scan(&total); err != nil {
+		return 0, err
+	}
+	ROW_CACHE.put(key, total, 8)
+	return total, nil
+}
+
+// nextCursor resumes after this page, or is empty on the last page.
+func (opts *ListOptions) nextCursor(total int) string {
+	if !opts.paged() || opts.Offset+opts.Limit >= total {
+		return ""
+	}
+	return encodeCursor(pageCursor{opts.Offset + opts.Limit, opts.Limit})
+}
+
+// setPageHeaders reports the total number of matching rows and, when there is
+// another page, an opaque cursor and Link to fetch it.
+func (opts *ListOptions) setPageHeaders(w http.ResponseWriter, r *http.Request, total int) {
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	cursor := opts.nextCursor(total)
+	if cursor == "" {
+		return
+	}
+
+	w.Header().Set("X-Next-Cursor", cursor)
+
+	next := *r.URL
+	query := next.Query()
+	query.Set("cursor", cursor)
+	query.Del("limit")
+	next.RawQuery = query.Encode()
+	w.Header().Add("Link", fmt.Sprintf("<%s>; rel=\"next\"", next.RequestURI()))
+}
@@ -1,54 +1,128 @@
 package main
 
 import (
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
-	"io"
+	"fmt"
+	"math"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 
-	"github.com/sirupsen/logrus"
 	log "github.com/sirupsen/logrus"
 )
 
 type FiveETable struct {
-	Name    string   `json:"name"`
-	Mapping []string `json:"mapping"`
+	Name    string            `json:"name"`
+	Mapping []string          `json:"mapping"`
+	Types   map[string]string `json:"types"`
 	file    string
 }
 
-func safeSQLValue(value interface{}) string {
+const (
+	TEXT      = "TEXT"
+	INTEGER   = "INTEGER"
+	NUMERIC   = "NUMERIC"
+	BOOLEAN   = "BOOLEAN"
+	JSONB     = "JSONB"
+	TIMESTAMP = "TIMESTAMP"
+)
+
+// Columns used for lookups are always stored as text, even when the source
+// JSON holds a number (e.g. the name of a level).
+var textColumns = map[string]bool{
+	"index": true,
+	"name":  true,
+	"url":   true,
+}
+
+func valueType(value interface{}) string {
 	switch v := value.(type) {
 	case string:
-		// Escape single quotes
-		return "'" + strings.ReplaceAll(v, "'", "''") + "'"
+		return TEXT
+	case bool:
+		return BOOLEAN
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) <= math.MaxInt32 {
+			return INTEGER
+		}
+		return NUMERIC
+	default:
+		return JSONB
+	}
+}
+
+func widenType(current string, next string) string {
+	switch {
+	case current == "" || current == next:
+		return next
+	case current == INTEGER && next == NUMERIC, current == NUMERIC && next == INTEGER:
+		return NUMERIC
 	default:
-		// Convert non-string values (e.g., maps, slices) to JSON
-		jsonValue, err := json.Marshal(v)
+		return JSONB
+	}
+}
+
+// inferColumnTypes picks the narrowest SQL type that holds every value seen
+// for each column. Nested objects, arrays and mixed columns become JSONB.
+func inferColumnTypes(table *FiveETable, data []map[string]interface{}) map[string]string {
+	types := make(map[string]string, len(table.Mapping))
+	for _, key := range table.Mapping {
+		colType := ""
+		for _, row := range data {
+			if value, ok := row[key]; ok && value != nil {
+				colType = widenType(colType, valueType(value))
+			}
+		}
+		if colType == "" || textColumns[key] {
+			colType = TEXT
+		}
+		types[key] = colType
+	}
+	return types
+}
+
+// sqlParam converts a decoded JSON value into a bind parameter for a column
+// of the given type. Nested values are passed as their JSON encoding.
+func sqlParam(value interface{}, colType string) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+	if s, ok := value.(string); ok && colType != JSONB {
+		return s, nil
+	}
+	switch colType {
+	case JSONB, TEXT:
+		jsonValue, err := json.Marshal(value)
 		if err != nil {
-			log.Printf("Error converting value to JSON: %v", err)
-			return "NULL" // Fail gracefully
+			return nil, err
 		}
-		return "'" + strings.ReplaceAll(string(jsonValue), "'", "''") + "'" // Store as JSON string
+		return string(jsonValue), nil
+	default:
+		return value, nil
 	}
 }
 
-func createTable(table *FiveETable, db *sql.DB) error {
+func createTable(table *FiveETable, tx *sql.Tx, dialect Dialect, types map[string]string) error {
 	log := log.WithField("table", table.Name)
 
 	query := "CREATE TABLE " + convertKey(table.Name) + " ("
 	for i, key := range table.Mapping {
+		colType := dialect.ColumnType(types[key])
 		key = convertKey(key)
 		if i != 0 {
 			query += ", "
 		}
-		query += key + " TEXT"
+		query += key + " " + colType
 	}
 	query += ");"
 
 	log.WithField("query", query).Debug("Executing query")
-	_, err := db.Exec(query)
+	_, err := tx.Exec(query)
 	if err != nil {
 		log.WithError(err).Error("Failed to create table")
 		return err
@@ -59,113 +133,268 @@ func createTable(table *FiveETable, db *sql.DB) error {
 	return nil
 }
 
-func insert(table *FiveETable, db *sql.DB, data []map[string]interface{}) error {
-	var err error
+// batchInsert loads rows with multi-row parameterized INSERTs, packing as many
+// rows into each statement as the bind parameter limit allows.
+func batchInsert(tx *sql.Tx, dialect Dialect, table string, columns []string, rows [][]interface{}) error {
+	log := log.WithField("table", table)
 
-	for _, row := range data {
-		log := log.WithFields(log.Fields{
-			"table": table,
-			"row":   row,
-		})
+	prefix := "INSERT INTO " + table + " (" + strings.Join(columns, ", ") + ") VALUES "
 
-		for key := range row {
-			found := false
-			for _, k := range table.Mapping {
-				if key == k {
-					found = true
-				}
-			}
-			if !found {
-				log.WithFields(logrus.Fields{
-					"key": key,
-				}).Fatalf("Extra key in row")
-			}
-		}
+	batchSize := dialect.MaxParams() / len(columns)
+	for start := 0; start < len(rows); start += batchSize {
+		end := min(start+batchSize, len(rows))
 
-		query := "INSERT INTO " + convertKey(table.Name) + " ("
-		values := "VALUES ("
-		for i, key := range table.Mapping {
+		var query strings.Builder
+		query.WriteString(prefix)
+		params := make([]interface{}, 0, (end-start)*len(columns))
+		for i, row := range rows[start:end] {
 			if i != 0 {
-				query += ", "
-				values += ", "
+				query.WriteString(", ")
 			}
-			query += convertKey(key)
-			if row[key] == nil {
-				log.WithFields(logrus.Fields{
-					"key":   key,
-					"value": row[key],
-				}).Debug("NULL value")
-				values += "NULL"
-			} else {
-				values += safeSQLValue(row[key])
+			query.WriteString("(")
+			for j, param := range row {
+				if j != 0 {
+					query.WriteString(", ")
+				}
+				params = append(params, param)
+				fmt.Fprintf(&query, "$%d", len(params))
 			}
+			query.WriteString(")")
 		}
-		query += ") " + values + ");"
 
-		_, err := db.Exec(query)
-		if err != nil {
-			log.WithError(err).Error("Failed to insert row")
+		if _, err := tx.Exec(query.String(), params...); err != nil {
+			log.WithError(err).Error("Failed to insert rows")
 			return err
 		}
+		log.Debugf("Inserted rows %d to %d", start, end)
+	}
+
+	return nil
+}
 
-		log.Debug("Inserted row")
+func insert(table *FiveETable, tx *sql.Tx, dialect Dialect, data []map[string]interface{}, types map[string]string) error {
+	log := log.WithField("table", table.Name)
+
+	columns := make([]string, len(table.Mapping))
+	for i, key := range table.Mapping {
+		columns[i] = convertKey(key)
+	}
+
+	rows := make([][]interface{}, len(data))
+	for i, row := range data {
+		rows[i] = make([]interface{}, len(table.Mapping))
+		for j, key := range table.Mapping {
+			param, err := sqlParam(row[key], types[key])
+			if err != nil {
+				log.WithError(err).WithField("key", key).Error("Failed to convert value")
+				return err
+			}
+			rows[i][j] = param
+		}
 	}
 
-	return err
+	return batchInsert(tx, dialect, convertKey(table.Name), columns, rows)
 }
 
-func populate(db *sql.DB) error {
-	log.Info("Populating database")
-	dir := "5e_data"
+// importTable replaces a table and records its new version inside a single
+// transaction, so a failure part way through leaves the previous import (or no
+// table at all) rather than a partial one.
+func importTable(db *sql.DB, table *FiveETable, data []map[string]interface{}, version DatasetVersion) error {
+	log := log.WithField("table", table.Name)
+	dialect := dialectFor(db)
 
-	populated_rows, err := db.Query("SELECT tablename FROM pg_tables WHERE schemaname = 'public';")
+	tx, err := db.Begin()
 	if err != nil {
-		log.WithError(err).Error("Failed to query database for populated check")
+		log.WithError(err).Error("Failed to begin transaction")
 		return err
 	}
-	defer populated_rows.Close()
+	defer tx.Rollback()
 
-	var already_populated = make(map[string]bool)
-	for populated_rows.Next() {
-		var name string
-		if err := populated_rows.Scan(&name); err != nil {
-			log.WithError(err).Error("Failed to scan row")
-			continue
-		}
-		already_populated[name] = true
+	query := "DROP TABLE IF EXISTS " + convertKey(table.Name)
+	if _, err := tx.Exec(query); err != nil {
+		log.WithError(err).Error("Failed to drop old table")
+		return err
 	}
 
-	for _, table := range TABLES {
-		if already_populated[table.Name] {
-			log.WithField("table", table.Name).Debugf("Table already populated")
-			continue
-		}
+	types := table.Types
+	if types == nil {
+		types = inferColumnTypes(table, data)
+	}
+	if err := createTable(table, tx, dialect, types); err != nil {
+		return err
+	}
 
-		log := log.WithField("table", table.Name)
-		file := filepath.Join(dir, table.file)
+	if err := insert(table, tx, dialect, data, types); err != nil {
+		return err
+	}
 
-		jsonFile, err := os.Open(file)
-		defer jsonFile.Close()
+	if err := indexReferences(tx, dialect, table, data); err != nil {
+		return err
+	}
 
-		jsonData, err := io.ReadAll(jsonFile)
-		if err != nil {
-			log.WithError(err).Error("Failed to read JSON file")
+	if err := indexSearch(tx, dialect, table, data); err != nil {
+		return err
+	}
+
+	if err := setDatasetVersion(tx, version); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.WithError(err).Error("Failed to commit import")
+		return err
+	}
+	forgetSuggestions(table.Name)
+	forgetSchema(table.Name)
+	forgetGraphQLSchema()
+	forgetOpenAPISpec()
+	forgetDataVersion()
+	ROW_CACHE.invalidate(table.Name)
+
+	log.WithField("hash", version.Hash).Infof("Imported %d rows", len(data))
+	return nil
+}
+
+func loadTableData(dir string, table *FiveETable) ([]map[string]interface{}, string, error) {
+	jsonData, err := os.ReadFile(filepath.Join(dir, table.file))
+	if err != nil {
+		return nil, "", err
+	}
+	sum := sha256.Sum256(jsonData)
+
+	var data []map[string]interface{}
+	if err := json.Unmarshal(jsonData, &data); err != nil {
+		return nil, "", err
+	}
+
+	return data, hex.EncodeToString(sum[:]), nil
+}
+
+// removeTable drops a table whose dataset was removed or is now skipped,
+// with its version, references and search entries.
+func removeTable(db *sql.DB, name string) error {
+	log := log.WithField("table", name)
+	if !identifierPattern.MatchString(name) {
+		return fmt.Errorf("invalid table name %q", name)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.WithError(err).Error("Failed to begin transaction")
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DROP TABLE IF EXISTS " + name); err != nil {
+		log.WithError(err).Error("Failed to drop table")
+		return err
+	}
+	for _, index := range []string{
+		"DELETE FROM " + VERSIONS_TABLE + " WHERE table_name = $1",
+		"DELETE FROM " + REFERENCES_TABLE + " WHERE source_table = $1",
+		"DELETE FROM " + SEARCH_TABLE + " WHERE source_table = $1",
+	} {
+		if _, err := tx.Exec(index, name); err != nil {
+			log.WithError(err).Error("Failed to clear table")
 			return err
 		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.WithError(err).Error("Failed to commit removal")
+		return err
+	}
+	forgetSuggestions(name)
+	forgetSchema(name)
+	forgetGraphQLSchema()
+	forgetOpenAPISpec()
+	forgetDataVersion()
+	ROW_CACHE.invalidate(name)
+
+	log.Info("Removed table")
+	return nil
+}
+
+func populate(db *sql.DB) error {
+	return populateFrom(db, "5e_data")
+}
+
+func populateFrom(db *sql.DB, dir string) error {
+	log.WithField("dialect", dialectFor(db).Name()).Info("Populating database")
 
-		var data []map[string]interface{}
-		if err := json.Unmarshal(jsonData, &data); err != nil {
-			log.WithError(err).Error("Failed to unmarshal JSON data")
+	if err := createVersionsTable(db); err != nil {
+		return err
+	}
+
+	if err := createReferencesTable(db); err != nil {
+		return err
+	}
+
+	if err := createSearchTable(db); err != nil {
+		return err
+	}
+
+	if err := createCharactersTable(db); err != nil {
+		return err
+	}
+
+	datasets, err := discoverDatasets(dir)
+	if err != nil {
+		log.WithError(err).Error("Failed to discover datasets")
+		return err
+	}
+	registerTables(datasets)
+
+	for _, drift := range DRIFT_REPORTS {
+		log.WithFields(log.Fields{
+			"table":     drift.Table,
+			"file":      drift.File,
+			"extra":     drift.Extra,
+			"missing":   drift.Missing,
+			"conflicts": drift.Conflicts,
+		}).Warn("Dataset no longer matches its mapping")
+	}
+
+	versions, err := getDatasetVersions(db)
+	if err != nil {
+		log.WithError(err).Error("Failed to query dataset versions")
+		return err
+	}
+
+	current := make(map[string]bool, len(datasets))
+	for _, ds := range datasets {
+		current[ds.Table.Name] = true
+	}
+	var removed []string
+	for name := range versions {
+		if !current[name] {
+			removed = append(removed, name)
+		}
+	}
+	sort.Strings(removed)
+	for _, name := range removed {
+		if err := removeTable(db, name); err != nil {
 			return err
 		}
+	}
 
-		if err := createTable(&table, db); err != nil {
-			log.WithError(err).Error("Failed to create table")
-			return err
+	for _, ds := range datasets {
+		table := ds.Table
+		log := log.WithField("table", table.Name)
+		if v, ok := versions[table.Name]; ok && v.Hash == ds.Hash && v.SchemaVersion == SCHEMA_VERSION {
+			log.Debugf("Table already populated")
+			continue
 		}
 
-		if err := insert(&table, db, data); err != nil {
-			log.WithError(err).Error("Failed to insert data")
+		version := DatasetVersion{
+			Table:         table.Name,
+			File:          table.file,
+			Hash:          ds.Hash,
+			SchemaVersion: SCHEMA_VERSION,
+			ImportedAt:    time.Now().UTC(),
+		}
+		if err := importTable(db, &table, ds.Data, version); err != nil {
+			log.WithError(err).Error("Failed to import table")
 			return err
 		}
 	}
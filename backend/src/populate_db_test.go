@@ -1,7 +1,13 @@
 package main
 
 import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 	log "github.com/sirupsen/logrus"
@@ -20,4 +26,362 @@ func TestPopulateDb(t *testing.T) {
 	if err := populate(db); err != nil {
 		t.Fatalf("Failed to populate database: %v", err)
 	}
+
+	before, err := getDatasetVersions(db)
+	if err != nil {
+		t.Fatalf("Failed to get dataset versions: %v", err)
+	}
+	if len(before) != len(TABLES) {
+		t.Fatalf("Expected %d dataset versions, got %d", len(TABLES), len(before))
+	}
+
+	if err := populate(db); err != nil {
+		t.Fatalf("Failed to populate database again: %v", err)
+	}
+
+	after, err := getDatasetVersions(db)
+	if err != nil {
+		t.Fatalf("Failed to get dataset versions: %v", err)
+	}
+	for name, v := range before {
+		if !after[name].ImportedAt.Equal(v.ImportedAt) {
+			t.Errorf("Unchanged table %s was re-imported", name)
+		}
+	}
+}
+
+func TestPopulateSqliteDb(t *testing.T) {
+	log.SetLevel(log.InfoLevel)
+
+	db, err := getTestSqliteDb(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to get test database: %v", err)
+	}
+	defer db.Close()
+
+	if err := populate(db); err != nil {
+		t.Fatalf("Failed to populate database: %v", err)
+	}
+
+	versions, err := getDatasetVersions(db)
+	if err != nil {
+		t.Fatalf("Failed to get dataset versions: %v", err)
+	}
+	if len(versions) != len(TABLES) {
+		t.Fatalf("Expected %d dataset versions, got %d", len(TABLES), len(versions))
+	}
+}
+
+func TestInferColumnTypes(t *testing.T) {
+	expected := map[string]map[string]string{
+		"monsters": {
+			"index":            TEXT,
+			"hit_points":       INTEGER,
+			"challenge_rating": NUMERIC,
+			"armor_class":      JSONB,
+			"speed":            JSONB,
+			"actions":          JSONB,
+		},
+		"spells": {
+			"level":         INTEGER,
+			"ritual":        BOOLEAN,
+			"concentration": BOOLEAN,
+			"school":        JSONB,
+		},
+		"levels": {
+			"name":  TEXT,
+			"level": INTEGER,
+		},
+	}
+
+	datasets, err := discoverDatasets("5e_data")
+	if err != nil {
+		t.Fatalf("Failed to discover datasets: %v", err)
+	}
+
+	for _, ds := range datasets {
+		columns, ok := expected[ds.Table.Name]
+		if !ok {
+			continue
+		}
+		name := ds.Table.Name
+
+		types := inferColumnTypes(&ds.Table, ds.Data)
+		for col, want := range columns {
+			if got := types[col]; got != want {
+				t.Errorf("%s.%s: expected %s, got %s", name, col, want, got)
+			}
+		}
+	}
+}
+
+func TestDiscoverDatasets(t *testing.T) {
+	datasets, err := discoverDatasets("5e_data")
+	if err != nil {
+		t.Fatalf("Failed to discover datasets: %v", err)
+	}
+
+	tables := make(map[string]FiveETable)
+	for _, ds := range datasets {
+		if _, ok := tables[ds.Table.Name]; ok {
+			t.Fatalf("Table %s discovered twice", ds.Table.Name)
+		}
+		tables[ds.Table.Name] = ds.Table
+	}
+
+	for _, name := range []string{"ability_scores", "packs", "weapons", "subraces"} {
+		if _, ok := tables[name]; !ok {
+			t.Errorf("Expected table %s to be discovered", name)
+		}
+	}
+	for _, key := range tables["subraces"].Mapping {
+		if key == "langauge_options" {
+			t.Errorf("Unexpected column %s in subraces", key)
+		}
+	}
+}
+
+func TestDiscoverDatasetsDrift(t *testing.T) {
+	dir := t.TempDir()
+	data := `[{"index": "a", "name": "A", "url": "/things/a", "colour": "red"}]`
+	if err := os.WriteFile(filepath.Join(dir, "5e-SRD-Things.json"), []byte(data), 0644); err != nil {
+		t.Fatalf("Failed to write dataset: %v", err)
+	}
+
+	TABLE_OVERRIDES["5e-SRD-Things.json"] = TableOverride{
+		Mapping: []string{"index", "name", "url", "size"},
+	}
+	defer delete(TABLE_OVERRIDES, "5e-SRD-Things.json")
+
+	datasets, err := discoverDatasets(dir)
+	if err != nil {
+		t.Fatalf("Failed to discover datasets: %v", err)
+	}
+	if len(datasets) != 1 {
+		t.Fatalf("Expected 1 dataset, got %d", len(datasets))
+	}
+
+	drift := datasets[0].Drift
+	if drift == nil {
+		t.Fatalf("Expected a drift report")
+	}
+	if drift.Table != "things" {
+		t.Errorf("Expected table things, got %s", drift.Table)
+	}
+	if len(drift.Extra) != 1 || drift.Extra[0] != "colour" {
+		t.Errorf("Expected extra key colour, got %v", drift.Extra)
+	}
+	if len(drift.Missing) != 1 || drift.Missing[0] != "size" {
+		t.Errorf("Expected missing key size, got %v", drift.Missing)
+	}
+}
+
+func TestDiscoverDatasetsConflict(t *testing.T) {
+	dir := t.TempDir()
+	for _, file := range []string{"5e-SRD-Things.json", "things.json"} {
+		data := fmt.Sprintf(`[{"index": "a", "name": %q, "url": "/things/a"}]`, file)
+		if err := os.WriteFile(filepath.Join(dir, file), []byte(data), 0644); err != nil {
+			t.Fatalf("Failed to write dataset: %v", err)
+		}
+	}
+
+	datasets, err := discoverDatasets(dir)
+	if err != nil {
+		t.Fatalf("Failed to discover datasets: %v", err)
+	}
+	if len(datasets) != 1 || datasets[0].Data[0]["name"] != "5e-SRD-Things.json" {
+		t.Fatalf("Expected only the first file to be imported, got %+v", datasets)
+	}
+	drift := datasets[0].Drift
+	if drift == nil || len(drift.Conflicts) != 1 || drift.Conflicts[0] != "things.json" {
+		t.Errorf("Expected things.json reported as a conflict, got %+v", drift)
+	}
+}
+
+func TestImportTableRollback(t *testing.T) {
+	log.SetLevel(log.InfoLevel)
+
+	db, err := getTestSqliteDb(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to get test database: %v", err)
+	}
+	defer db.Close()
+	for _, create := range []func(*sql.DB) error{createVersionsTable, createReferencesTable, createSearchTable} {
+		if err := create(db); err != nil {
+			t.Fatalf("Failed to create table: %v", err)
+		}
+	}
+
+	table := FiveETable{
+		Name:    "things",
+		Mapping: []string{"index", "name", "size"},
+		Types:   map[string]string{"index": TEXT, "name": TEXT, "size": INTEGER},
+		file:    "5e-SRD-Things.json",
+	}
+	rows := func(n int) []map[string]interface{} {
+		data := make([]map[string]interface{}, n)
+		for i := range data {
+			data[i] = map[string]interface{}{"index": fmt.Sprint(i), "name": fmt.Sprint("Thing ", i), "size": i}
+		}
+		return data
+	}
+	version := func(hash string) DatasetVersion {
+		return DatasetVersion{Table: table.Name, File: table.file, Hash: hash,
+			SchemaVersion: SCHEMA_VERSION, ImportedAt: time.Now().UTC()}
+	}
+
+	// More rows than fit in one INSERT, with the last one unbindable, so
+	// the failure comes after a batch has already been written.
+	batch := SQLITE.MaxParams() / len(table.Mapping)
+	bad := rows(batch + 10)
+	bad[len(bad)-1]["size"] = []int{1}
+
+	if err := importTable(db, &table, bad, version("bad")); err == nil {
+		t.Fatalf("Expected the import to fail")
+	}
+	var exists int
+	db.QueryRow("SELECT count(*) FROM sqlite_master WHERE name = 'things'").Scan(&exists)
+	if exists != 0 {
+		t.Errorf("Expected no table after a failed first import")
+	}
+
+	if err := importTable(db, &table, rows(3), version("good")); err != nil {
+		t.Fatalf("Failed to import table: %v", err)
+	}
+	if err := importTable(db, &table, bad, version("bad")); err == nil {
+		t.Fatalf("Expected the import to fail")
+	}
+
+	if n, err := countRows(db, "things", ""); err != nil || n != 3 {
+		t.Errorf("Expected the 3 rows of the previous import, got %d (%v)", n, err)
+	}
+	versions, err := getDatasetVersions(db)
+	if err != nil {
+		t.Fatalf("Failed to get dataset versions: %v", err)
+	}
+	if versions["things"].Hash != "good" {
+		t.Errorf("Expected the previous version to be kept, got %+v", versions["things"])
+	}
+}
+
+func TestPopulateSqliteChanges(t *testing.T) {
+	log.SetLevel(log.InfoLevel)
+
+	db, err := getTestSqliteDb(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to get test database: %v", err)
+	}
+	defer db.Close()
+
+	dir := t.TempDir()
+	write := func(file string, data string) {
+		if err := os.WriteFile(filepath.Join(dir, file), []byte(data), 0644); err != nil {
+			t.Fatalf("Failed to write dataset: %v", err)
+		}
+	}
+	reimport := func() map[string]DatasetVersion {
+		t.Helper()
+		if err := populateFrom(db, dir); err != nil {
+			t.Fatalf("Failed to populate database: %v", err)
+		}
+		versions, err := getDatasetVersions(db)
+		if err != nil {
+			t.Fatalf("Failed to get dataset versions: %v", err)
+		}
+		return versions
+	}
+	tableExists := func(name string) bool {
+		var n int
+		db.QueryRow("SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = $1", name).Scan(&n)
+		return n > 0
+	}
+
+	write("5e-SRD-Things.json", `[{"index": "a", "name": "A", "url": "/things/a", "desc": "An apple"}]`)
+	write("5e-SRD-Widgets.json", `[{"index": "w", "name": "W", "url": "/widgets/w", "desc": "A widget"}]`)
+	first := reimport()
+
+	// A changed file is re-imported, and only that file.
+	write("5e-SRD-Things.json", `[
+		{"index": "a", "name": "A", "url": "/things/a"},
+		{"index": "b", "name": "B", "url": "/things/b"}
+	]`)
+	second := reimport()
+	if second["things"].Hash == first["things"].Hash || !second["things"].ImportedAt.After(first["things"].ImportedAt) {
+		t.Errorf("Expected things to be re-imported, got %+v", second["things"])
+	}
+	if n, _ := countRows(db, "things", ""); n != 2 {
+		t.Errorf("Expected the 2 new rows of things, got %d", n)
+	}
+	if !second["widgets"].ImportedAt.Equal(first["widgets"].ImportedAt) {
+		t.Errorf("Unchanged table widgets was re-imported")
+	}
+
+	// So is a table imported by an older SCHEMA_VERSION.
+	if _, err := db.Exec("UPDATE "+VERSIONS_TABLE+" SET schema_version = $1 WHERE table_name = 'widgets'",
+		SCHEMA_VERSION-1); err != nil {
+		t.Fatalf("Failed to update schema version: %v", err)
+	}
+	third := reimport()
+	if third["widgets"].SchemaVersion != SCHEMA_VERSION || !third["widgets"].ImportedAt.After(second["widgets"].ImportedAt) {
+		t.Errorf("Expected widgets to be re-imported, got %+v", third["widgets"])
+	}
+
+	// Removed and skipped datasets lose their tables and versions.
+	os.Remove(filepath.Join(dir, "5e-SRD-Widgets.json"))
+	TABLE_OVERRIDES["5e-SRD-Things.json"] = TableOverride{Skip: true}
+	defer delete(TABLE_OVERRIDES, "5e-SRD-Things.json")
+	write("5e-SRD-Gadgets.json", `[{"index": "g", "name": "G", "url": "/gadgets/g"}]`)
+
+	fourth := reimport()
+	if len(fourth) != 1 || fourth["gadgets"].Hash == "" {
+		t.Errorf("Expected only gadgets to have a version, got %v", fourth)
+	}
+	for _, name := range []string{"things", "widgets"} {
+		if tableExists(name) {
+			t.Errorf("Expected table %s to be dropped", name)
+		}
+	}
+	var indexed int
+	db.QueryRow("SELECT count(*) FROM " + SEARCH_TABLE + " WHERE source_table = 'widgets'").Scan(&indexed)
+	if indexed != 0 {
+		t.Errorf("Expected widgets to be removed from the search index, got %d rows", indexed)
+	}
+}
+
+func TestDiscoverDatasetsPinnedDrift(t *testing.T) {
+	datasets, err := discoverDatasets("5e_data")
+	if err != nil {
+		t.Fatalf("Failed to discover datasets: %v", err)
+	}
+	for _, ds := range datasets {
+		if ds.Drift != nil {
+			t.Errorf("Unexpected drift in %s: %+v", ds.Table.Name, ds.Drift)
+		}
+	}
+
+	// The SRD alignments file gains a key and loses one.
+	dir := t.TempDir()
+	data := `[{"index": "lawful-good", "name": "Lawful Good", "abbreviation": "LG",
+		"url": "/alignments/lawful-good", "colour": "white"}]`
+	if err := os.WriteFile(filepath.Join(dir, "5e-SRD-Alignments.json"), []byte(data), 0644); err != nil {
+		t.Fatalf("Failed to write dataset: %v", err)
+	}
+
+	datasets, err = discoverDatasets(dir)
+	if err != nil {
+		t.Fatalf("Failed to discover datasets: %v", err)
+	}
+	if len(datasets) != 1 {
+		t.Fatalf("Expected 1 dataset, got %d", len(datasets))
+	}
+	ds := datasets[0]
+	if !reflect.DeepEqual(ds.Table.Mapping, TABLE_OVERRIDES["5e-SRD-Alignments.json"].Mapping) {
+		t.Errorf("Expected the pinned mapping, got %v", ds.Table.Mapping)
+	}
+	if ds.Drift == nil {
+		t.Fatalf("Expected a drift report")
+	}
+	if !reflect.DeepEqual(ds.Drift.Extra, []string{"colour"}) || !reflect.DeepEqual(ds.Drift.Missing, []string{"desc"}) {
+		t.Errorf("Expected colour extra and desc missing, got %+v", ds.Drift)
+	}
 }
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	log "github.com/sirupsen/logrus"
+)
+
+// REFERENCES_TABLE is the reverse index of every embedded reference, built
+// from the rows of each table as it is imported.
+const REFERENCES_TABLE = "srd_references"
+
+var REFERENCE_COLUMNS = []string{
+	"source_table",
+	"source_index",
+	"source_name",
+	"source_url",
+	"path",
+	"target_url",
+}
+
+type Reference struct {
+	Path      string
+	TargetUrl string
+}
+
+type Backlink struct {
+	Index string `json:"index"`
+	Name  string `json:"name"`
+	Url   string `json:"url"`
+}
+
+func createReferencesTable(db *sql.DB) error {
+	queries := []string{
+		"CREATE TABLE IF NOT EXISTS " + REFERENCES_TABLE + " (" +
+			"source_table TEXT NOT NULL, " +
+			"source_index TEXT NOT NULL, " +
+			"source_name TEXT, " +
+			"source_url TEXT, " +
+			"path TEXT NOT NULL, " +
+			"target_url TEXT NOT NULL);",
+		"CREATE INDEX IF NOT EXISTS " + REFERENCES_TABLE + "_target ON " +
+			REFERENCES_TABLE + " (target_url);",
+	}
+
+	for _, query := range queries {
+		if _, err := db.Exec(query); err != nil {
+			log.WithError(err).Error("Failed to create references table")
+			return err
+		}
+	}
+	return nil
+}
+
+// extractReferences lists the embedded references in a row along with the
+// dotted path of the field they were found in. Array elements share their
+// array's path, as with ?expand=.
+func extractReferences(row map[string]interface{}) []Reference {
+	var refs []Reference
+	seen := make(map[Reference]bool)
+
+	var walk func(v interface{}, path string)
+	walk = func(v interface{}, path string) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			if u, ok := isReference(v); ok {
+				ref := Reference{path, u}
+				if !seen[ref] {
+					seen[ref] = true
+					refs = append(refs, ref)
+				}
+			}
+			for key, child := range v {
+				walk(child, joinPath(path, key))
+			}
+		case []interface{}:
+			for _, child := range v {
+				walk(child, path)
+			}
+		}
+	}
+
+	for key, value := range row {
+		walk(value, key)
+	}
+	return refs
+}
+
+func stringValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case string:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// indexReferences replaces the reverse index entries for a table with the
+// references found in its newly imported rows.
+func indexReferences(tx *sql.Tx, dialect Dialect, table *FiveETable, data []map[string]interface{}) error {
+	log := log.WithField("table", table.Name)
+
+	_, err := tx.Exec("DELETE FROM "+REFERENCES_TABLE+" WHERE source_table = $1", table.Name)
+	if err != nil {
+		log.WithError(err).Error("Failed to clear references")
+		return err
+	}
+
+	var rows [][]interface{}
+	for _, row := range data {
+		for _, ref := range extractReferences(row) {
+			rows = append(rows, []interface{}{
+				table.Name,
+				stringValue(row["index"]),
+				stringValue(row["name"]),
+				stringValue(row["url"]),
+				ref.Path,
+				ref.TargetUrl,
+			})
+		}
+	}
+
+	if err := batchInsert(tx, dialect, REFERENCES_TABLE, REFERENCE_COLUMNS, rows); err != nil {
+		log.WithError(err).Error("Failed to index references")
+		return err
+	}
+
+	log.Debugf("Indexed %d references", len(rows))
+	return nil
+}
+
+func (dbc DbClient) referencesHandler(w http.ResponseWriter, r *http.Request) {
+	db := dbc.DB
+	vars := mux.Vars(r)
+	table, _ := url.PathUnescape(vars["table"])
+	index, _ := url.PathUnescape(vars["index"])
+	log := logrus.WithFields(logrus.Fields{
+		"table":  table,
+		"index":  index,
+		"method": "references",
+		"ip":     r.RemoteAddr,
+	})
+	log.Debugf("Received request for references to %s in %s\n", index, table)
+
+	if !verifyTable(table) {
+		log.Warnf("Invalid table %s\n", table)
+		writeInvalidTable(w, r, table)
+		return
+	}
+
+	var target string
+	query := fmt.Sprintf("SELECT url FROM %s WHERE _index = $1", table)
+	if err := db.QueryRow(query, index).Scan(&target); err != nil {
+		if err == sql.ErrNoRows {
+			log.Warn("No results")
+			writeNoResults(w, r)
+			return
+		}
+		log.WithError(err).Warn("Failed to query database")
+		writeInternalError(w, r, "Failed to query database")
+		return
+	}
+
+	rows, err := db.Query("SELECT source_table, source_index, source_name, source_url, path FROM "+
+		REFERENCES_TABLE+" WHERE target_url = $1 ORDER BY source_table, path, source_index", target)
+	if err != nil {
+		log.WithError(err).Warn("Failed to query database")
+		writeInternalError(w, r, "Failed to query database")
+		return
+	}
+	defer rows.Close()
+
+	// Grouped by referring table, then by the field path holding the reference.
+	references := make(map[string]map[string][]Backlink)
+	for rows.Next() {
+		var source, path string
+		var name, u sql.NullString
+		var link Backlink
+		if err := rows.Scan(&source, &link.Index, &name, &u, &path); err != nil {
+			log.WithError(err).Warn("Failed to scan row")
+			writeInternalError(w, r, "Failed to scan row")
+			return
+		}
+		link.Name = name.String
+		link.Url = u.String
+
+		if references[source] == nil {
+			references[source] = make(map[string][]Backlink)
+		}
+		references[source][path] = append(references[source][path], link)
+	}
+	if err := rows.Err(); err != nil {
+		log.WithError(err).Warn("Failed to read rows")
+		writeInternalError(w, r, "Failed to read rows")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"table":      table,
+		"index":      index,
+		"url":        target,
+		"references": references,
+	})
+}
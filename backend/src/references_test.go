@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestExtractReferences(t *testing.T) {
+	ranger := map[string]interface{}{
+		"index": "ranger",
+		"name":  "Ranger",
+		"url":   "/classes/ranger",
+		"proficiency_choices": []interface{}{
+			map[string]interface{}{
+				"from": map[string]interface{}{
+					"options": []interface{}{
+						map[string]interface{}{"item": ref("skill-perception", "/proficiencies/skill-perception")},
+						map[string]interface{}{"item": ref("skill-stealth", "/proficiencies/skill-stealth")},
+					},
+				},
+			},
+		},
+		"saving_throws": []interface{}{ref("str", "/ability-scores/str")},
+		"class_levels":  "/classes/ranger/levels",
+	}
+
+	refs := extractReferences(ranger)
+	found := make(map[Reference]bool)
+	for _, r := range refs {
+		found[r] = true
+	}
+
+	expected := []Reference{
+		{"proficiency_choices.from.options.item", "/proficiencies/skill-perception"},
+		{"proficiency_choices.from.options.item", "/proficiencies/skill-stealth"},
+		{"saving_throws", "/ability-scores/str"},
+	}
+	for _, r := range expected {
+		if !found[r] {
+			t.Errorf("Expected reference %v, got %v", r, refs)
+		}
+	}
+	if len(refs) != len(expected) {
+		t.Errorf("Expected %d references, got %d: %v", len(expected), len(refs), refs)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/AppalachianCoding/rpg-app/backend/dice"
+	"github.com/sirupsen/logrus"
+)
+
+// rollHandler serves /roll?expr=, rolling dice notation like the
+// hit_points_roll and damage_dice in the data. The result records its seed,
+// and passing it back as ?seed= repeats the same roll.
+func rollHandler(w http.ResponseWriter, r *http.Request) {
+	log := logrus.WithFields(logrus.Fields{
+		"method": "roll",
+		"ip":     r.RemoteAddr,
+	})
+	log.Debug("Received roll request")
+
+	query := r.URL.Query()
+	expr, err := dice.Parse(query.Get("expr"))
+	if err != nil {
+		log.WithError(err).Warn("Invalid dice expression")
+		writeInvalidParameter(w, r, &ParamError{"expr", err})
+		return
+	}
+
+	var result dice.Result
+	if s := query.Get("seed"); s != "" {
+		seed, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			log.WithError(err).Warn("Invalid seed")
+			writeInvalidParameter(w, r, paramError("seed", "seed must be a whole number"))
+			return
+		}
+		result = expr.RollSeed(seed)
+	} else {
+		result = expr.RollSeed(dice.NewSeed())
+		// Every roll without a seed is different, so nothing can reuse it.
+		w.Header().Set("Cache-Control", "no-store")
+	}
+
+	log.WithFields(logrus.Fields{
+		"expr":  result.Expr,
+		"total": result.Total,
+	}).Info("Rolled dice")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/AppalachianCoding/rpg-app/backend/dice"
+)
+
+func TestRollHandler(t *testing.T) {
+	roll := func(query string) (*httptest.ResponseRecorder, dice.Result) {
+		req := httptest.NewRequest("GET", "/roll?"+query, nil)
+		rec := httptest.NewRecorder()
+		rollHandler(rec, req)
+		var result dice.Result
+		json.NewDecoder(rec.Body).Decode(&result)
+		return rec, result
+	}
+
+	rec, first := roll("expr=18d10%2B36")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", rec.Code)
+	}
+	if rec.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("Expected an unseeded roll not to be cached")
+	}
+	if len(first.Terms) != 2 || len(first.Terms[0].Dice) != 18 {
+		t.Fatalf("Expected 18 dice and a modifier, got %+v", first)
+	}
+	if first.Total < 54 || first.Total > 216 {
+		t.Errorf("Total %d out of range", first.Total)
+	}
+
+	_, again := roll(fmt.Sprintf("expr=18d10%%2B36&seed=%d", first.Seed))
+	if !reflect.DeepEqual(first, again) {
+		t.Errorf("Expected the seed to repeat %+v, got %+v", first, again)
+	}
+
+	for _, query := range []string{"", "expr=4d", "expr=1d6&seed=-1"} {
+		rec, _ := roll(query)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: Expected status 400, got %d", query, rec.Code)
+		}
+	}
+}
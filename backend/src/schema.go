@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+const JSON_SCHEMA_DIALECT = "https://json-schema.org/draft/2020-12/schema"
+
+// A string field is an enum when it takes at most MAX_ENUM_VALUES short
+// values, each seen ENUM_MIN_REPEATS times on average, like a monster's size.
+const (
+	MAX_ENUM_VALUES    = 16
+	MAX_ENUM_VALUE_LEN = 40
+	ENUM_MIN_REPEATS   = 3
+)
+
+// notEnums are top-level fields never treated as enums, even in small tables.
+var notEnums = map[string]bool{"index": true, "name": true, "url": true, "desc": true}
+
+// schemaNode accumulates every value seen at one place in the rows.
+type schemaNode struct {
+	values  int
+	nulls   int
+	bools   int
+	ints    int
+	floats  int
+	strings int
+	// distinct string values, until there are too many to be an enum
+	enum    map[string]bool
+	tooMany bool
+
+	objects    int
+	properties map[string]*schemaNode
+	refTables  map[string]bool
+
+	arrays int
+	items  *schemaNode
+}
+
+func newSchemaNode() *schemaNode {
+	return &schemaNode{enum: make(map[string]bool)}
+}
+
+func (n *schemaNode) add(v interface{}) {
+	n.values++
+	switch v := v.(type) {
+	case nil:
+		n.nulls++
+	case bool:
+		n.bools++
+	case int64:
+		n.ints++
+	case float64:
+		if v == math.Trunc(v) {
+			n.ints++
+		} else {
+			n.floats++
+		}
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			n.ints++
+		} else {
+			n.floats++
+		}
+	case string:
+		n.strings++
+		if !n.tooMany {
+			if len(v) > MAX_ENUM_VALUE_LEN || len(n.enum) >= MAX_ENUM_VALUES && !n.enum[v] {
+				n.tooMany = true
+				n.enum = nil
+			} else {
+				n.enum[v] = true
+			}
+		}
+	case map[string]interface{}:
+		n.objects++
+		if n.properties == nil {
+			n.properties = make(map[string]*schemaNode)
+			n.refTables = make(map[string]bool)
+		}
+		for key, child := range v {
+			if n.properties[key] == nil {
+				n.properties[key] = newSchemaNode()
+			}
+			n.properties[key].add(child)
+		}
+		if u, ok := isReference(v); ok {
+			for _, table := range URL_PATTERNS[urlPattern(u)] {
+				n.refTables[table] = true
+			}
+		}
+	case []interface{}:
+		n.arrays++
+		if n.items == nil {
+			n.items = newSchemaNode()
+		}
+		for _, child := range v {
+			n.items.add(child)
+		}
+	}
+}
+
+// isReferenceShape reports whether every object seen was a reference, with
+// no fields beyond index, name and url.
+func (n *schemaNode) isReferenceShape() bool {
+	for key, prop := range n.properties {
+		switch key {
+		case "index", "url":
+			if prop.values != n.objects || prop.strings != n.objects {
+				return false
+			}
+		case "name":
+		default:
+			return false
+		}
+	}
+	return n.properties["url"] != nil
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// schema writes out what was seen at a dotted field path as JSON Schema.
+// Values of more than one kind become an anyOf, except that null just
+// widens the type.
+func (n *schemaNode) schema(path string) map[string]interface{} {
+	var kinds []map[string]interface{}
+
+	if n.strings > 0 {
+		s := map[string]interface{}{"type": "string"}
+		if !n.tooMany && !notEnums[path] && len(n.enum) > 1 &&
+			n.strings >= ENUM_MIN_REPEATS*len(n.enum) {
+			s["enum"] = sortedKeys(n.enum)
+		}
+		kinds = append(kinds, s)
+	}
+	switch {
+	case n.floats > 0:
+		kinds = append(kinds, map[string]interface{}{"type": "number"})
+	case n.ints > 0:
+		kinds = append(kinds, map[string]interface{}{"type": "integer"})
+	}
+	if n.bools > 0 {
+		kinds = append(kinds, map[string]interface{}{"type": "boolean"})
+	}
+	if n.objects > 0 {
+		kinds = append(kinds, n.objectSchema(path))
+	}
+	if n.arrays > 0 {
+		s := map[string]interface{}{"type": "array"}
+		if n.items != nil && n.items.values > 0 {
+			s["items"] = n.items.schema(path)
+		}
+		kinds = append(kinds, s)
+	}
+
+	switch {
+	case len(kinds) == 0:
+		// Only ever null, or an array that was always empty.
+		if n.nulls > 0 {
+			return map[string]interface{}{"type": "null"}
+		}
+		return map[string]interface{}{}
+	case len(kinds) == 1 && n.nulls == 0:
+		return kinds[0]
+	case len(kinds) == 1 && kinds[0]["type"] != nil:
+		kinds[0]["type"] = []string{kinds[0]["type"].(string), "null"}
+		return kinds[0]
+	}
+
+	anyOf := make([]interface{}, 0, len(kinds)+1)
+	for _, k := range kinds {
+		anyOf = append(anyOf, k)
+	}
+	if n.nulls > 0 {
+		anyOf = append(anyOf, map[string]interface{}{"type": "null"})
+	}
+	return map[string]interface{}{"anyOf": anyOf}
+}
+
+func (n *schemaNode) objectSchema(path string) map[string]interface{} {
+	if n.isReferenceShape() {
+		s := map[string]interface{}{"$ref": "#/$defs/reference"}
+		if tables := sortedKeys(n.refTables); len(tables) > 0 {
+			s["x-tables"] = tables
+			s["description"] = "Reference to a row of " + strings.Join(tables, " or ") + "."
+		}
+		return s
+	}
+	return n.propertiesSchema(path)
+}
+
+func (n *schemaNode) propertiesSchema(path string) map[string]interface{} {
+	properties := make(map[string]interface{}, len(n.properties))
+	required := []string{}
+	for key, prop := range n.properties {
+		if path == "" {
+			properties[key] = prop.schema(key)
+		} else {
+			properties[key] = prop.schema(path + "." + key)
+		}
+		if prop.values == n.objects {
+			required = append(required, key)
+		}
+	}
+	sort.Strings(required)
+	return map[string]interface{}{
+		"type":       "object",
+		"properties": properties,
+		"required":   required,
+	}
+}
+
+var referenceDef = map[string]interface{}{
+	"type":        "object",
+	"description": "A link to a row of another table, which /{table}/{index} or ?expand= can fetch.",
+	"properties": map[string]interface{}{
+		"index": map[string]interface{}{"type": "string"},
+		"name":  map[string]interface{}{"type": "string"},
+		"url":   map[string]interface{}{"type": "string"},
+	},
+	"required": []string{"index", "url"},
+}
+
+// allowNull widens a schema to also accept null.
+func allowNull(schema map[string]interface{}) map[string]interface{} {
+	switch t := schema["type"].(type) {
+	case string:
+		schema["type"] = []string{t, "null"}
+		return schema
+	case []string:
+		for _, s := range t {
+			if s == "null" {
+				return schema
+			}
+		}
+		schema["type"] = append(t, "null")
+		return schema
+	}
+	return map[string]interface{}{"anyOf": []interface{}{schema, map[string]interface{}{"type": "null"}}}
+}
+
+// inferSchema describes the rows of a table as JSON Schema. Fields missing
+// from some rows are left out of required. A row's columns are NULL where
+// its dataset entry lacked the field, so at the top level those count as
+// missing, and optional columns also allow null.
+func inferSchema(table string, rows []map[string]interface{}) map[string]interface{} {
+	root := newSchemaNode()
+	for _, row := range rows {
+		present := make(map[string]interface{}, len(row))
+		for key, value := range row {
+			if value != nil {
+				present[key] = value
+			}
+		}
+		root.add(present)
+	}
+
+	schema := root.propertiesSchema("")
+	properties := schema["properties"].(map[string]interface{})
+	for key, prop := range root.properties {
+		if prop.values < root.objects {
+			properties[key] = allowNull(properties[key].(map[string]interface{}))
+		}
+	}
+	schema["$schema"] = JSON_SCHEMA_DIALECT
+	schema["$id"] = API_PREFIX + "/schema/" + table
+	schema["title"] = table
+	schema["$defs"] = map[string]interface{}{"reference": referenceDef}
+	return schema
+}
+
+// Schemas are inferred on first request and dropped when the table is
+// imported.
+var (
+	schemaMu    sync.Mutex
+	schemaCache = make(map[string]map[string]interface{})
+)
+
+func forgetSchema(table string) {
+	schemaMu.Lock()
+	defer schemaMu.Unlock()
+	delete(schemaCache, table)
+}
+
+func (dbc DbClient) inferredSchema(table string) (map[string]interface{}, error) {
+	schemaMu.Lock()
+	defer schemaMu.Unlock()
+	if schema, ok := schemaCache[table]; ok {
+		return schema, nil
+	}
+
+	rows, err := queryMaps(dbc.DB, "SELECT * FROM "+table)
+	if err != nil {
+		return nil, err
+	}
+	schema := inferSchema(table, rows)
+	schemaCache[table] = schema
+	return schema, nil
+}
+
+func (dbc DbClient) schemaHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	table, _ := url.PathUnescape(vars["table"])
+	log := logrus.WithFields(logrus.Fields{
+		"table":  table,
+		"method": "schema",
+		"ip":     r.RemoteAddr,
+	})
+	log.Debugf("Received request for the schema of %s\n", table)
+
+	if !verifyTable(table) {
+		log.Warnf("Invalid table %s\n", table)
+		writeInvalidTable(w, r, table)
+		return
+	}
+
+	schema, err := dbc.inferredSchema(table)
+	if err != nil {
+		log.WithError(err).Warn("Failed to query database")
+		writeInternalError(w, r, "Failed to query database")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/schema+json")
+	json.NewEncoder(w).Encode(schema)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestInferSchema(t *testing.T) {
+	var rows []map[string]interface{}
+	sizes := []string{"Tiny", "Small", "Medium", "Large"}
+	for i := 0; i < 12; i++ {
+		row := map[string]interface{}{
+			"index": json.Number("1"),
+			"size":  sizes[i%len(sizes)],
+			"speed": map[string]interface{}{"walk": "30 ft."},
+			"school": map[string]interface{}{
+				"index": "evocation", "name": "Evocation", "url": "/magic-schools/evocation",
+			},
+			"level":   int64(i),
+			"subtype": nil,
+		}
+		if i%2 == 0 {
+			row["subtype"] = "goblinoid"
+			row["speed"].(map[string]interface{})["fly"] = "60 ft."
+		}
+		rows = append(rows, row)
+	}
+
+	schema := inferSchema("monsters", rows)
+	properties := schema["properties"].(map[string]interface{})
+
+	size := properties["size"].(map[string]interface{})
+	if !reflect.DeepEqual(size["enum"], []string{"Large", "Medium", "Small", "Tiny"}) {
+		t.Errorf("Expected size to be an enum, got %v", size)
+	}
+
+	speed := properties["speed"].(map[string]interface{})
+	if !reflect.DeepEqual(speed["required"], []string{"walk"}) {
+		t.Errorf("Expected only speed.walk to be required, got %v", speed["required"])
+	}
+
+	if properties["school"].(map[string]interface{})["$ref"] != "#/$defs/reference" {
+		t.Errorf("Expected school to be a reference, got %v", properties["school"])
+	}
+
+	subtype := properties["subtype"].(map[string]interface{})
+	if !reflect.DeepEqual(subtype["type"], []string{"string", "null"}) {
+		t.Errorf("Expected subtype to be a nullable string, got %v", subtype)
+	}
+	for _, key := range schema["required"].([]string) {
+		if key == "subtype" {
+			t.Error("Expected subtype to be optional")
+		}
+	}
+
+	if properties["level"].(map[string]interface{})["type"] != "integer" {
+		t.Errorf("Expected level to be an integer, got %v", properties["level"])
+	}
+}
+
+func TestSqliteSchema(t *testing.T) {
+	srv := newSqliteTestServer(t)
+
+	res, err := http.Get(srv.URL + "/v1/schema/magic_items")
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", res.StatusCode)
+	}
+
+	var schema struct {
+		ID         string `json:"$id"`
+		Properties map[string]struct {
+			Ref        string                 `json:"$ref"`
+			XTables    []string               `json:"x-tables"`
+			Properties map[string]interface{} `json:"properties"`
+		} `json:"properties"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&schema); err != nil {
+		t.Fatalf("Failed to decode response body: %v", err)
+	}
+	if schema.ID != "/v1/schema/magic_items" {
+		t.Errorf("Expected the schema to identify itself by its /v1 path, got %q", schema.ID)
+	}
+
+	rarity := schema.Properties["rarity"].Properties["name"].(map[string]interface{})
+	if enum, _ := rarity["enum"].([]interface{}); len(enum) < 5 {
+		t.Errorf("Expected rarity.name to be an enum, got %v", rarity)
+	}
+	category := schema.Properties["equipment_category"]
+	if category.Ref == "" || len(category.XTables) != 1 || category.XTables[0] != "equipment_categories" {
+		t.Errorf("Expected equipment_category to reference equipment_categories, got %+v", category)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/sirupsen/logrus"
+	log "github.com/sirupsen/logrus"
+)
+
+// SEARCH_TABLE holds the name and description of every row in every table,
+// with a full-text index over them. It is rebuilt for a table whenever that
+// table is imported.
+const SEARCH_TABLE = "srd_search"
+
+const (
+	DEFAULT_SEARCH_LIMIT = 20
+	MAX_SEARCH_LIMIT     = 100
+)
+
+var SEARCH_COLUMNS = []string{
+	"source_table",
+	"source_index",
+	"name",
+	"url",
+	"type",
+	"body",
+}
+
+func createSearchTable(db *sql.DB) error {
+	for _, query := range dialectFor(db).SearchSchema() {
+		if _, err := db.Exec(query); err != nil {
+			log.WithError(err).Error("Failed to create search table")
+			return err
+		}
+	}
+	return nil
+}
+
+// searchText flattens a desc field, which is either a string or a list of
+// paragraphs.
+func searchText(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case []interface{}:
+		paragraphs := make([]string, 0, len(v))
+		for _, p := range v {
+			if s, ok := p.(string); ok {
+				paragraphs = append(paragraphs, s)
+			}
+		}
+		return strings.Join(paragraphs, "\n")
+	default:
+		return ""
+	}
+}
+
+// indexSearch replaces the search entries for a table with its newly
+// imported rows.
+func indexSearch(tx *sql.Tx, dialect Dialect, table *FiveETable, data []map[string]interface{}) error {
+	log := log.WithField("table", table.Name)
+
+	_, err := tx.Exec("DELETE FROM "+SEARCH_TABLE+" WHERE source_table = $1", table.Name)
+	if err != nil {
+		log.WithError(err).Error("Failed to clear search index")
+		return err
+	}
+
+	var rows [][]interface{}
+	for _, row := range data {
+		name, _ := stringValue(row["name"]).(string)
+		body := searchText(row["desc"])
+		if name == "" && body == "" {
+			continue
+		}
+
+		// Only a plain string type is kept, e.g. a monster's "beast".
+		var rowType interface{}
+		if t, ok := row["type"].(string); ok {
+			rowType = t
+		}
+		rows = append(rows, []interface{}{
+			table.Name,
+			stringValue(row["index"]),
+			name,
+			stringValue(row["url"]),
+			rowType,
+			body,
+		})
+	}
+
+	if err := batchInsert(tx, dialect, SEARCH_TABLE, SEARCH_COLUMNS, rows); err != nil {
+		log.WithError(err).Error("Failed to index search text")
+		return err
+	}
+
+	log.Debugf("Indexed %d rows for search", len(rows))
+	return nil
+}
+
+func hasWord(q string) bool {
+	return strings.IndexFunc(q, func(c rune) bool {
+		return unicode.IsLetter(c) || unicode.IsDigit(c)
+	}) >= 0
+}
+
+// searchQuery builds the search for q, narrowed to rows of the given tables
+// and type when they are set. The tables must already be verified.
+func (dbc DbClient) searchQuery(q string, tables []string, typ string, limit int) (string, []interface{}) {
+	var conditions []string
+	var params []interface{}
+	placeholder := func(v interface{}) string {
+		params = append(params, v)
+		// $1 is the search text.
+		return fmt.Sprintf("$%d", len(params)+1)
+	}
+
+	if len(tables) > 0 {
+		in := make([]string, len(tables))
+		for i, table := range tables {
+			in[i] = placeholder(table)
+		}
+		conditions = append(conditions, "source_table IN ("+strings.Join(in, ", ")+")")
+	}
+	if typ != "" {
+		conditions = append(conditions, "lower(type) = lower("+placeholder(typ)+")")
+	}
+
+	sqlQuery, text := dbc.Dialect().SearchQuery(q, strings.Join(conditions, " AND "), limit)
+	return sqlQuery, append([]interface{}{text}, params...)
+}
+
+// searchHandler serves GET /search?q=, ranking matches in the name and
+// description of rows across every table. ?table= (comma separated) and
+// ?type= narrow the results and ?limit= caps them.
+func (dbc DbClient) searchHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	q := query.Get("q")
+	log := logrus.WithFields(logrus.Fields{
+		"q":      q,
+		"method": "search",
+		"ip":     r.RemoteAddr,
+	})
+	log.Debugf("Received search for %s\n", q)
+
+	if !hasWord(q) {
+		log.Warn("Missing search query")
+		writeInvalidParameter(w, r, paramError("q", "Missing search query, use ?q="))
+		return
+	}
+
+	var tables []string
+	if t := query.Get("table"); t != "" {
+		for _, table := range strings.Split(t, ",") {
+			table = strings.TrimSpace(table)
+			if !verifyTable(table) {
+				log.Warnf("Invalid table %s\n", table)
+				writeInvalidTable(w, r, table)
+				return
+			}
+			tables = append(tables, table)
+		}
+	}
+
+	limit := DEFAULT_SEARCH_LIMIT
+	if l := query.Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 || limit > MAX_SEARCH_LIMIT {
+			log.Warnf("Invalid limit %s\n", l)
+			writeInvalidParameter(w, r, paramError("limit", "limit must be between 1 and %d", MAX_SEARCH_LIMIT))
+			return
+		}
+	}
+
+	sqlQuery, params := dbc.searchQuery(q, tables, query.Get("type"), limit)
+	if err := QueryDb(w, r, dbc.DB, log, sqlQuery, params...); err != nil {
+		log.WithError(err).Warn("Failed to search")
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestFtsQuery(t *testing.T) {
+	if q := ftsQuery(`magic "mis OR -x`); q != `"magic" "mis" "OR" "x"` {
+		t.Errorf("Unexpected FTS query %s", q)
+	}
+}
+
+func searchResults(t *testing.T, url string) []map[string]interface{} {
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("%s: expected status 200, got %d", url, res.StatusCode)
+	}
+
+	var results []map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&results); err != nil {
+		t.Fatalf("Failed to decode response body: %v", err)
+	}
+	return results
+}
+
+func TestSqliteSearch(t *testing.T) {
+	srv := newSqliteTestServer(t)
+
+	results := searchResults(t, srv.URL+"/v1/search?q=darkvision&limit=100")
+	tables := make(map[string]bool)
+	for _, row := range results {
+		tables[row["table"].(string)] = true
+		if !strings.Contains(strings.ToLower(row["snippet"].(string)), "<mark>darkvision</mark>") {
+			t.Errorf("Expected a highlighted snippet, got %v", row["snippet"])
+		}
+	}
+	if !tables["spells"] || !tables["traits"] {
+		t.Errorf("Expected matches in spells and traits, got %v", tables)
+	}
+	if results[0]["index"] != "darkvision" {
+		t.Errorf("Expected the Darkvision rows to rank first, got %v", results[0])
+	}
+
+	for _, row := range searchResults(t, srv.URL+"/v1/search?q=darkvision&table=spells") {
+		if row["table"] != "spells" {
+			t.Errorf("Expected only spells, got %v", row)
+		}
+	}
+
+	for _, row := range searchResults(t, srv.URL+"/v1/search?q=red&type=dragon") {
+		if row["type"] != "dragon" {
+			t.Errorf("Expected only dragons, got %v", row)
+		}
+	}
+
+	for _, path := range []string{"/v1/search", "/v1/search?q=fire&table=not_a_table", "/v1/search?q=fire&limit=0"} {
+		res, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", path, res.StatusCode)
+		}
+	}
+}
+
+func TestSqliteSearchEscapesSnippet(t *testing.T) {
+	db, err := getTestSqliteDb(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to get test database: %v", err)
+	}
+	defer db.Close()
+	if err := createSearchTable(db); err != nil {
+		t.Fatalf("Failed to create search table: %v", err)
+	}
+	_, err = db.Exec("INSERT INTO "+SEARCH_TABLE+" (source_table, source_index, name, url, type, body) "+
+		"VALUES ($1, $2, $3, $4, $5, $6)",
+		"spells", "x", "X", "/spells/x", "", `<img src=x onerror="alert('fire')"> & fire`)
+	if err != nil {
+		t.Fatalf("Failed to index row: %v", err)
+	}
+
+	dbc := DbClient{db}
+	query, params := dbc.searchQuery("fire", nil, "", 10)
+	rows, err := queryMaps(db, query, params...)
+	if err != nil || len(rows) != 1 {
+		t.Fatalf("Expected 1 result, got %v (%v)", rows, err)
+	}
+	expected := `&lt;img src=x onerror=&#34;alert(&#39;<mark>fire</mark>&#39;)&#34;&gt; &amp; <mark>fire</mark>`
+	if rows[0]["snippet"] != expected {
+		t.Errorf("Expected %s, got %s", expected, rows[0]["snippet"])
+	}
+}
@@ -0,0 +1,5 @@
+// Package srdpb holds the protobuf messages and gRPC service of the SRD API,
+// generated from srd.proto.
+package srdpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative srd.proto
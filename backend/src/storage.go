@@ -0,0 +1,284 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/mattn/go-sqlite3"
+	log "github.com/sirupsen/logrus"
+)
+
+// Dialect covers the differences between the databases DbClient can sit on.
+// Queries are otherwise written once, using $n placeholders, which both
+// Postgres and SQLite accept.
+type Dialect interface {
+	Name() string
+	// ColumnType spells one of the importer's column types (TEXT, INTEGER,
+	// NUMERIC, BOOLEAN, JSONB, TIMESTAMP) for this database.
+	ColumnType(colType string) string
+	// MaxParams is the most bind parameters a single statement may use.
+	MaxParams() int
+	// JsonMatch is a condition that holds when some scalar reached by
+	// following path into a JSON column satisfies cond. Arrays are searched
+	// at every step, so "classes.index" looks at the index of each class.
+	JsonMatch(column string, path []string, cond func(v JsonScalar) string) string
+	// SearchSchema creates SEARCH_TABLE with a full-text index over the name
+	// and body columns.
+	SearchSchema() []string
+	// SearchQuery ranks the rows of SEARCH_TABLE matching the user's query q,
+	// best first. The query text binds to $1; where holds further conditions
+	// using later placeholders.
+	SearchQuery(q string, where string, limit int) (string, interface{})
+}
+
+type postgresDialect struct{}
+
+func (postgresDialect) Name() string {
+	return "postgres"
+}
+
+func (postgresDialect) ColumnType(colType string) string {
+	if colType == TIMESTAMP {
+		return "TIMESTAMPTZ"
+	}
+	return colType
+}
+
+func (postgresDialect) MaxParams() int {
+	return 65535
+}
+
+func (postgresDialect) JsonMatch(column string, path []string, cond func(v JsonScalar) string) string {
+	// In lax mode each accessor unwraps arrays, and the trailing [*] unwraps
+	// an array found at the end of the path.
+	jsonPath := "$"
+	for _, key := range path {
+		jsonPath += `."` + key + `"`
+	}
+	jsonPath += "[*]"
+
+	v := JsonScalar{
+		Text:    "CASE WHEN jsonb_typeof(j.v) = 'string' THEN j.v #>> '{}' END",
+		Number:  "CASE WHEN jsonb_typeof(j.v) = 'number' THEN (j.v #>> '{}')::numeric END",
+		Bool:    "CASE WHEN jsonb_typeof(j.v) = 'boolean' THEN (j.v #>> '{}')::boolean END",
+		NotNull: "jsonb_typeof(j.v) <> 'null'",
+	}
+	return fmt.Sprintf("EXISTS (SELECT 1 FROM jsonb_path_query(%s, '%s') AS j(v) WHERE %s)",
+		column, jsonPath, cond(v))
+}
+
+func (postgresDialect) SearchSchema() []string {
+	return []string{
+		"CREATE TABLE IF NOT EXISTS " + SEARCH_TABLE + " (" +
+			"source_table TEXT NOT NULL, " +
+			"source_index TEXT NOT NULL, " +
+			"name TEXT, " +
+			"url TEXT, " +
+			"type TEXT, " +
+			"body TEXT, " +
+			"document tsvector GENERATED ALWAYS AS (" +
+			"setweight(to_tsvector('english', coalesce(name, '')), 'A') || " +
+			"setweight(to_tsvector('english', coalesce(body, '')), 'B')) STORED);",
+		"CREATE INDEX IF NOT EXISTS " + SEARCH_TABLE + "_document ON " +
+			SEARCH_TABLE + " USING GIN (document);",
+	}
+}
+
+func (postgresDialect) SearchQuery(q string, where string, limit int) (string, interface{}) {
+	query := "SELECT source_table AS \"table\", source_index AS _index, name, url, type, " +
+		"ts_rank(document, q) AS rank, " +
+		"ts_headline('english', " + escapeHTML("coalesce(nullif(body, ''), name)") + ", q, " +
+		"'StartSel=<mark>, StopSel=</mark>, MaxFragments=2, MaxWords=20, MinWords=5') AS snippet " +
+		"FROM " + SEARCH_TABLE + ", websearch_to_tsquery('english', $1) AS q " +
+		"WHERE document @@ q"
+	if where != "" {
+		query += " AND " + where
+	}
+	query += fmt.Sprintf(" ORDER BY rank DESC, source_table, source_index LIMIT %d", limit)
+	return query, q
+}
+
+type sqliteDialect struct{}
+
+func (sqliteDialect) Name() string {
+	return "sqlite"
+}
+
+// SQLite keeps the declared type name, which the driver uses to hand back
+// booleans and timestamps, and decodeColumn uses to spot JSON.
+func (sqliteDialect) ColumnType(colType string) string {
+	if colType == JSONB {
+		return "JSON"
+	}
+	return colType
+}
+
+func (sqliteDialect) MaxParams() int {
+	return 32766
+}
+
+func (sqliteDialect) JsonMatch(column string, path []string, cond func(v JsonScalar) string) string {
+	jsonPath := "$"
+	for _, key := range path {
+		jsonPath += "." + key
+	}
+
+	v := JsonScalar{
+		Text:    "CASE WHEN j.type = 'text' THEN j.atom END",
+		Number:  "CASE WHEN j.type IN ('integer', 'real') THEN j.atom END",
+		Bool:    "CASE WHEN j.type IN ('true', 'false') THEN j.type = 'true' END",
+		NotNull: "j.type NOT IN ('null', 'object', 'array')",
+	}
+	return fmt.Sprintf("EXISTS (SELECT 1 FROM json_tree(%s) AS j WHERE srd_json_path(j.fullkey) = '%s' AND %s)",
+		column, jsonPath, cond(v))
+}
+
+// SQLite's FTS4 is compiled into go-sqlite3, but it has no ranking function,
+// so srd_search_rank scores its matchinfo.
+func (sqliteDialect) SearchSchema() []string {
+	return []string{
+		"CREATE VIRTUAL TABLE IF NOT EXISTS " + SEARCH_TABLE + " USING fts4(" +
+			"source_table, source_index, name, url, type, body, " +
+			"notindexed=source_table, notindexed=source_index, notindexed=url, " +
+			"notindexed=type, tokenize=porter);",
+	}
+}
+
+func (sqliteDialect) SearchQuery(q string, where string, limit int) (string, interface{}) {
+	query := "SELECT source_table AS \"table\", source_index AS _index, name, url, type, " +
+		"srd_search_rank(matchinfo(" + SEARCH_TABLE + ", 'pcx')) AS rank, " +
+		markSnippet("snippet("+SEARCH_TABLE+", char(2), char(3), '...', -1, 20)") + " AS snippet " +
+		"FROM " + SEARCH_TABLE + " WHERE " + SEARCH_TABLE + " MATCH $1"
+	if where != "" {
+		query += " AND " + where
+	}
+	query += fmt.Sprintf(" ORDER BY rank DESC, source_table, source_index LIMIT %d", limit)
+	return query, ftsQuery(q)
+}
+
+// escapeHTML escapes the text of a SQL expression as html.EscapeString
+// does, so highlighted snippets can only contain the markup we add.
+func escapeHTML(expr string) string {
+	for _, r := range [][2]string{
+		{"&", "&amp;"}, {"<", "&lt;"}, {">", "&gt;"}, {`"`, "&#34;"}, {"'", "&#39;"},
+	} {
+		expr = fmt.Sprintf("replace(%s, '%s', '%s')", expr,
+			strings.ReplaceAll(r[0], "'", "''"), r[1])
+	}
+	return expr
+}
+
+// markSnippet escapes an FTS4 snippet highlighted between char(2) and
+// char(3), then turns those into <mark> tags. FTS4 can only highlight the
+// raw text, so unlike ts_headline it can't be given escaped text.
+func markSnippet(expr string) string {
+	return "replace(replace(" + escapeHTML(expr) + ", char(2), '<mark>'), char(3), '</mark>')"
+}
+
+// ftsQuery turns free text into an FTS4 query matching rows that contain
+// every word, so punctuation in user input can't be a syntax error.
+func ftsQuery(q string) string {
+	words := strings.FieldsFunc(q, func(c rune) bool {
+		return !unicode.IsLetter(c) && !unicode.IsDigit(c)
+	})
+	for i, word := range words {
+		words[i] = `"` + word + `"`
+	}
+	return strings.Join(words, " ")
+}
+
+// searchRank scores an FTS4 matchinfo 'pcx' blob: for each phrase and
+// column, hits in this row weighted by how rare the phrase is overall.
+// Hits in the name count for more than hits in the body.
+func searchRank(info []byte) float64 {
+	ints := make([]uint32, len(info)/4)
+	for i := range ints {
+		ints[i] = binary.NativeEndian.Uint32(info[i*4:])
+	}
+	if len(ints) < 2 {
+		return 0
+	}
+
+	weights := map[int]float64{2: 10, 5: 1}
+	phrases, cols := int(ints[0]), int(ints[1])
+	rank := 0.0
+	for p := 0; p < phrases; p++ {
+		for c := 0; c < cols; c++ {
+			x := ints[2+3*(p*cols+c):]
+			if len(x) < 3 || x[0] == 0 {
+				continue
+			}
+			hits, total := float64(x[0]), float64(x[1])
+			rank += weights[c] * hits / total
+		}
+	}
+	return rank
+}
+
+// jsonTreePath drops array subscripts and key quoting from a json_tree
+// fullkey, so $[2].from.options[0].item becomes $.from.options.item.
+func jsonTreePath(fullkey string) string {
+	var path strings.Builder
+	inSubscript := false
+	for _, c := range fullkey {
+		switch {
+		case c == '[':
+			inSubscript = true
+		case c == ']':
+			inSubscript = false
+		case inSubscript || c == '"':
+		default:
+			path.WriteRune(c)
+		}
+	}
+	return path.String()
+}
+
+// SQLITE_DRIVER is go-sqlite3 with the functions our queries rely on.
+const SQLITE_DRIVER = "sqlite3_srd"
+
+func init() {
+	sql.Register(SQLITE_DRIVER, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			if err := conn.RegisterFunc("srd_json_path", jsonTreePath, true); err != nil {
+				return err
+			}
+			return conn.RegisterFunc("srd_search_rank", searchRank, true)
+		},
+	})
+}
+
+var POSTGRES Dialect = postgresDialect{}
+var SQLITE Dialect = sqliteDialect{}
+
+func dialectFor(db *sql.DB) Dialect {
+	if _, ok := db.Driver().(*sqlite3.SQLiteDriver); ok {
+		return SQLITE
+	}
+	return POSTGRES
+}
+
+func (dbc DbClient) Dialect() Dialect {
+	return dialectFor(dbc.DB)
+}
+
+// openSqlite opens (creating if needed) a file-backed database. WAL and a busy
+// timeout let the server read while an import is writing.
+func openSqlite(path string) (*sql.DB, error) {
+	dsn := fmt.Sprintf("file:%s?_journal_mode=WAL&_busy_timeout=5000", path)
+	db, err := sql.Open(SQLITE_DRIVER, dsn)
+	if err != nil {
+		log.WithError(err).Error("Failed to open sqlite database")
+		return nil, err
+	}
+	if err = db.Ping(); err != nil {
+		log.WithError(err).Error("Failed to ping sqlite database")
+		return nil, err
+	}
+
+	log.WithField("path", path).Info("Opened sqlite database")
+	return db, nil
+}
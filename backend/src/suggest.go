@@ -0,0 +1,274 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	DEFAULT_SUGGEST_LIMIT = 10
+	MAX_SUGGEST_LIMIT     = 50
+	MIN_SUGGEST_SCORE     = 0.3
+)
+
+// Suggestion is one autocomplete candidate. Score is 1 for an exact prefix
+// and falls towards 0 as the name gets less similar to what was typed.
+type Suggestion struct {
+	Index string  `json:"index"`
+	Name  string  `json:"name"`
+	Score float64 `json:"score"`
+}
+
+type suggestEntry struct {
+	index    string
+	name     string
+	norm     string
+	trigrams map[string]bool
+}
+
+func newSuggestEntry(index, name string) suggestEntry {
+	norm := normalizeName(name)
+	return suggestEntry{index, name, norm, trigrams(norm)}
+}
+
+// The names of a table are small enough to score in memory on every
+// keystroke, so they are read once and dropped when the table is imported.
+var (
+	suggestMu    sync.Mutex
+	suggestCache = make(map[string][]suggestEntry)
+)
+
+func forgetSuggestions(table string) {
+	suggestMu.Lock()
+	defer suggestMu.Unlock()
+	delete(suggestCache, table)
+}
+
+func (dbc DbClient) suggestEntries(table string) ([]suggestEntry, error) {
+	suggestMu.Lock()
+	defer suggestMu.Unlock()
+	if entries, ok := suggestCache[table]; ok {
+		return entries, nil
+	}
+
+	rows, err := dbc.Query(fmt.Sprintf("SELECT _index, name FROM %s WHERE name IS NOT NULL", table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []suggestEntry
+	for rows.Next() {
+		var index, name string
+		if err := rows.Scan(&index, &name); err != nil {
+			return nil, err
+		}
+		entries = append(entries, newSuggestEntry(index, name))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	suggestCache[table] = entries
+	return entries, nil
+}
+
+// normalizeName lowercases s and collapses everything but letters and digits
+// into single spaces, so "Potion of Healing (Greater)" and "potion of
+// healing greater" compare equal.
+func normalizeName(s string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(s), func(c rune) bool {
+		return !unicode.IsLetter(c) && !unicode.IsDigit(c)
+	}), " ")
+}
+
+// trigrams are taken pg_trgm style, per word with two spaces in front and
+// one behind.
+func trigrams(s string) map[string]bool {
+	set := make(map[string]bool)
+	for _, word := range strings.Fields(s) {
+		r := []rune("  " + word + " ")
+		for i := 0; i+3 <= len(r); i++ {
+			set[string(r[i:i+3])] = true
+		}
+	}
+	return set
+}
+
+func trigramSimilarity(a, b map[string]bool) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+	shared := 0
+	for t := range a {
+		if b[t] {
+			shared++
+		}
+	}
+	return float64(shared) / float64(len(a)+len(b)-shared)
+}
+
+// editDistance is the optimal string alignment distance, which counts a
+// swapped pair of letters as one edit.
+func editDistance(a, b []rune) int {
+	d := make([][]int, len(a)+1)
+	for i := range d {
+		d[i] = make([]int, len(b)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			d[i][j] = min(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				d[i][j] = min(d[i][j], d[i-2][j-2]+1)
+			}
+		}
+	}
+	return d[len(a)][len(b)]
+}
+
+// wordPrefixes reports whether each word of q starts the matching word of
+// name, so "mag mis" finds "Magic Missile".
+func wordPrefixes(q, name string) bool {
+	qw, nw := strings.Fields(q), strings.Fields(name)
+	if len(qw) > len(nw) {
+		return false
+	}
+	for i, w := range qw {
+		if !strings.HasPrefix(nw[i], w) {
+			return false
+		}
+	}
+	return true
+}
+
+// suggestScore rates how well a partially typed query matches a name. Prefix
+// matches come first; otherwise the better of trigram similarity and the
+// edit distance to the start of the name decides, which covers typos in
+// both short and long input.
+func suggestScore(q string, qTrigrams map[string]bool, e suggestEntry) float64 {
+	switch {
+	case strings.HasPrefix(e.norm, q):
+		return 1
+	case wordPrefixes(q, e.norm):
+		return 0.9
+	case strings.Contains(e.norm, q):
+		return 0.8
+	}
+
+	qr, nr := []rune(q), []rune(e.norm)
+	if len(nr) > len(qr) {
+		nr = nr[:len(qr)]
+	}
+	distance := float64(editDistance(qr, nr)) / float64(len(qr))
+	return 0.7 * max(1-distance, trigramSimilarity(qTrigrams, e.trigrams))
+}
+
+func rankSuggestions(q string, entries []suggestEntry, limit int) []Suggestion {
+	q = normalizeName(q)
+	qTrigrams := trigrams(q)
+
+	var suggestions []Suggestion
+	for _, e := range entries {
+		score := suggestScore(q, qTrigrams, e)
+		if score >= MIN_SUGGEST_SCORE {
+			suggestions = append(suggestions, Suggestion{e.index, e.name, score})
+		}
+	}
+
+	// Among equally good matches the shorter name is the likelier target.
+	sort.Slice(suggestions, func(i, j int) bool {
+		a, b := suggestions[i], suggestions[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		if len(a.Name) != len(b.Name) {
+			return len(a.Name) < len(b.Name)
+		}
+		return a.Name < b.Name
+	})
+	if len(suggestions) > limit {
+		suggestions = suggestions[:limit]
+	}
+	return suggestions
+}
+
+// suggestHandler serves GET /suggest/{table}?q=, returning the names that
+// best match what has been typed so far, with their index slugs.
+func (dbc DbClient) suggestHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	table, _ := url.PathUnescape(vars["table"])
+	query := r.URL.Query()
+	q := query.Get("q")
+	log := logrus.WithFields(logrus.Fields{
+		"table":  table,
+		"q":      q,
+		"method": "suggest",
+		"ip":     r.RemoteAddr,
+	})
+	log.Debugf("Received suggest request for %s in %s\n", q, table)
+
+	if !verifyTable(table) {
+		log.Warnf("Invalid table %s\n", table)
+		writeInvalidTable(w, r, table)
+		return
+	}
+	if !hasWord(q) {
+		log.Warn("Missing suggest query")
+		writeInvalidParameter(w, r, paramError("q", "Missing query, use ?q="))
+		return
+	}
+
+	limit := DEFAULT_SUGGEST_LIMIT
+	if l := query.Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 || limit > MAX_SUGGEST_LIMIT {
+			log.Warnf("Invalid limit %s\n", l)
+			writeInvalidParameter(w, r, paramError("limit", "limit must be between 1 and %d", MAX_SUGGEST_LIMIT))
+			return
+		}
+	}
+
+	addVary(w.Header(), "Accept")
+	format, err := negotiateFormat(r)
+	if err != nil {
+		notAcceptable(w, r, log, err)
+		return
+	}
+
+	entries, err := dbc.suggestEntries(table)
+	if err != nil {
+		log.WithError(err).Warn("Failed to query database")
+		writeInternalError(w, r, "Failed to query database")
+		return
+	}
+
+	suggestions := rankSuggestions(q, entries, limit)
+	out := newRowWriter(w, format, false)
+	for _, s := range suggestions {
+		if err := out.WriteRow(s); err != nil {
+			log.WithError(err).Warn("Failed to encode result")
+			return
+		}
+	}
+	if err := out.Close(); err != nil {
+		log.WithError(err).Warn("Failed to encode result")
+	}
+}
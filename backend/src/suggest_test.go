@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestRankSuggestions(t *testing.T) {
+	var entries []suggestEntry
+	for _, name := range []string{"Fireball", "Fire Bolt", "Fire Shield", "Magic Missile", "Magic Mouth", "Mage Armor"} {
+		entries = append(entries, newSuggestEntry(normalizeName(name), name))
+	}
+
+	tests := []struct {
+		q    string
+		want string
+	}{
+		{"firebal", "Fireball"},
+		{"fierball", "Fireball"},
+		{"magic mis", "Magic Missile"},
+		{"mag mis", "Magic Missile"},
+		{"majic misile", "Magic Missile"},
+		{"fire bo", "Fire Bolt"},
+		{"shield", "Fire Shield"},
+	}
+	for _, tt := range tests {
+		suggestions := rankSuggestions(tt.q, entries, 3)
+		if len(suggestions) == 0 || suggestions[0].Name != tt.want {
+			t.Errorf("%q: expected %s first, got %v", tt.q, tt.want, suggestions)
+		}
+	}
+
+	if suggestions := rankSuggestions("xyzzy", entries, 3); len(suggestions) != 0 {
+		t.Errorf("Expected no suggestions, got %v", suggestions)
+	}
+}
+
+func TestSqliteSuggest(t *testing.T) {
+	srv := newSqliteTestServer(t)
+
+	res, err := http.Get(srv.URL + "/v1/suggest/spells?q=firebal&limit=5")
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", res.StatusCode)
+	}
+
+	var suggestions []Suggestion
+	if err := json.NewDecoder(res.Body).Decode(&suggestions); err != nil {
+		t.Fatalf("Failed to decode response body: %v", err)
+	}
+	if len(suggestions) == 0 || suggestions[0].Index != "fireball" {
+		t.Errorf("Expected fireball first, got %v", suggestions)
+	}
+
+	for path, status := range map[string]int{
+		"/v1/suggest/spells":             http.StatusBadRequest,
+		"/v1/suggest/not_a_table?q=fire": http.StatusBadRequest,
+		"/v1/suggest/spells?q=qqqqqqqq":  http.StatusOK,
+	} {
+		res, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		res.Body.Close()
+		if res.StatusCode != status {
+			t.Errorf("%s: expected status %d, got %d", path, status, res.StatusCode)
+		}
+	}
+}
@@ -1,489 +1,543 @@
 package main
 
-var TABLE_NAMES = []string{
-	"ability_scores",
-	"alignments",
-	"backgrounds",
-	"classes",
-	"conditions",
-	"damage_types",
-	"equipment_categories",
-	"rpg_gear",
-	"gear",
-	"tools",
-	"mounts",
-	"weapons",
-	"feats",
-	"features",
-	"languages",
-	"levels",
-	"magic_items",
-	"magic_schools",
-	"monsters",
-	"proficiencies",
-	"races",
-	"rule_sections",
-	"rules",
-	"skills",
-	"spells",
-	"subclasses",
-	"subraces",
-	"traits",
-	"weapon_properties",
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// TableOverride adjusts what discovery derives from a dataset file. Name
+// renames the table, Mapping pins its columns and Skip leaves the file out.
+type TableOverride struct {
+	Name    string
+	Mapping []string
+	Skip    bool
 }
 
-var TABLES = map[string]FiveETable{
-	"ability_scores": {
-		"ability_scores",
-		[]string{
-			"index",
-			"name",
-			"full_name",
-			"desc",
-			"skills",
-			"url",
-		},
-		"5e-SRD-Ability-Scores.json",
-	},
-	"alignments": {
-		"alignments",
-		[]string{
-			"index",
-			"name",
-			"abbreviation",
-			"desc",
-			"url",
-		},
-		"5e-SRD-Alignments.json",
-	},
-	"backgrounds": {
-		"backgrounds",
-		[]string{
-			"index",
-			"name",
-			"starting_proficiencies",
-			"language_options",
-			"starting_equipment",
-			"starting_equipment_options",
-			"feature",
-			"personality_traits",
-			"ideals",
-			"bonds",
-			"flaws",
-			"url",
-		},
-		"5e-SRD-Backgrounds.json",
-	},
-	"classes": {
-		"classes",
-		[]string{
-			"index",
-			"name",
-			"hit_die",
-			"proficiency_choices",
-			"proficiencies",
-			"saving_throws",
-			"starting_equipment",
-			"starting_equipment_options",
-			"class_levels",
-			"multi_classing",
-			"subclasses",
-			"spellcasting",
-			"spells",
-			"url",
-		},
-		"5e-SRD-Classes.json",
-	},
-	"conditions": {
-		"conditions",
-		[]string{
-			"index",
-			"name",
-			"desc",
-			"url",
-		},
-		"5e-SRD-Conditions.json",
-	},
-	"damage_types": {
-		"damage_types",
-		[]string{
-			"index",
-			"name",
-			"desc",
-			"url",
-		},
-		"5e-SRD-Damage-Types.json",
-	},
-	"equipment_categories": {
-		"equipment_categories",
-		[]string{
-			"index",
-			"name",
-			"equipment",
-			"url",
-		},
-		"5e-SRD-Equipment-Categories.json",
-	},
-	"rpg_gear": {
-		"rpg_gear",
-		[]string{
-			"index",
-			"name",
-			"equipment_category",
-			"gear_category",
-			"weight",
-			"cost",
-			"desc",
-			"quantity",
-			"url",
-		},
-		"5e-SRD-Rpg-Gear.json",
-	},
-	"gear": {
-		"gear",
-		[]string{
-			"index",
-			"name",
-			"equipment_category",
-			"armor_category",
-			"armor_class",
-			"str_minimum",
-			"stealth_disadvantage",
-			"weight",
-			"cost",
-			"url",
-		},
-		"5e-SRD-Gear.json",
-	},
-	"tools": {
-		"tools",
-		[]string{
-			"index",
-			"name",
-			"equipment_category",
-			"tool_category",
-			"weight",
-			"cost",
-			"desc",
-			"url",
-		},
-		"5e-SRD-Tools.json",
-	},
-	"mounts": {
-		"mounts",
-		[]string{
-			"index",
-			"name",
-			"equipment_category",
-			"vehicle_category",
-			"cost",
-			"weight",
-			"desc",
-			"speed",
-			"capacity",
-			"url",
-		},
-		"5e-SRD-Mounts.json",
-	},
-	"weapons": {
-		"weapons",
-		[]string{
-			"two_handed_damage",
-			"special",
-			"index",
-			"throw_range",
-			"name",
-			"equipment_category",
-			"weapon_category",
-			"weapon_range",
-			"category_range",
-			"cost",
-			"damage",
-			"range",
-			"weight",
-			"properties",
-			"url",
-		},
-		"5e-SRD-Weapons.json",
-	},
-	"feats": {
-		"feats",
-		[]string{
-			"index",
-			"name",
-			"prerequisites",
-			"desc",
-			"url",
-		},
-		"5e-SRD-Feats.json",
-	},
-	"features": {
+// TABLE_OVERRIDES is keyed by file name within 5e_data. The SRD files have
+// their columns pinned, so a change to their keys shows up in /drift rather
+// than silently changing the table.
+var TABLE_OVERRIDES = map[string]TableOverride{
+	// Older copy of 5e-SRD-Weapons.json that would clash with its table.
+	"weapons.json": {Skip: true},
+
+	"5e-SRD-Ability-Scores.json": {Mapping: []string{
+		"index",
+		"name",
+		"full_name",
+		"desc",
+		"skills",
+		"url",
+	}},
+	"5e-SRD-Alignments.json": {Mapping: []string{
+		"index",
+		"name",
+		"abbreviation",
+		"desc",
+		"url",
+	}},
+	"5e-SRD-Backgrounds.json": {Mapping: []string{
+		"index",
+		"name",
+		"starting_proficiencies",
+		"language_options",
+		"starting_equipment",
+		"starting_equipment_options",
+		"feature",
+		"personality_traits",
+		"ideals",
+		"bonds",
+		"flaws",
+		"url",
+	}},
+	"5e-SRD-Classes.json": {Mapping: []string{
+		"index",
+		"name",
+		"hit_die",
+		"proficiency_choices",
+		"proficiencies",
+		"saving_throws",
+		"starting_equipment",
+		"starting_equipment_options",
+		"class_levels",
+		"multi_classing",
+		"subclasses",
+		"spellcasting",
+		"spells",
+		"url",
+	}},
+	"5e-SRD-Conditions.json": {Mapping: []string{
+		"index",
+		"name",
+		"desc",
+		"url",
+	}},
+	"5e-SRD-Damage-Types.json": {Mapping: []string{
+		"index",
+		"name",
+		"desc",
+		"url",
+	}},
+	"5e-SRD-Equipment-Categories.json": {Mapping: []string{
+		"index",
+		"name",
+		"equipment",
+		"url",
+	}},
+	"5e-SRD-Feats.json": {Mapping: []string{
+		"index",
+		"name",
+		"prerequisites",
+		"desc",
+		"url",
+	}},
+	"5e-SRD-Features.json": {Mapping: []string{
+		"index",
+		"reference",
+		"class",
+		"subclass",
+		"name",
+		"level",
+		"prerequisites",
+		"feature_specific",
+		"parent",
+		"desc",
+		"url",
+	}},
+	"5e-SRD-Gear.json": {Mapping: []string{
+		"index",
+		"name",
+		"equipment_category",
+		"armor_category",
+		"armor_class",
+		"str_minimum",
+		"stealth_disadvantage",
+		"weight",
+		"cost",
+		"url",
+	}},
+	"5e-SRD-Languages.json": {Mapping: []string{
+		"index",
+		"name",
+		"type",
+		"typical_speakers",
+		"script",
+		"desc",
+		"url",
+	}},
+	"5e-SRD-Levels.json": {Mapping: []string{
+		"name",
+		"level",
+		"ability_score_bonuses",
+		"prof_bonus",
 		"features",
-		[]string{
-			"index",
-			"reference",
-			"class",
-			"subclass",
-			"name",
-			"level",
-			"prerequisites",
-			"feature_specific",
-			"parent",
-			"desc",
-			"url",
-		},
-		"5e-SRD-Features.json",
-	},
-	"languages": {
-		"languages",
-		[]string{
-			"index",
-			"name",
-			"type",
-			"typical_speakers",
-			"script",
-			"desc",
-			"url",
-		},
-		"5e-SRD-Languages.json",
-	},
-	"levels": {
-		"levels",
-		[]string{
-			"name",
-			"level",
-			"ability_score_bonuses",
-			"prof_bonus",
-			"features",
-			"class_specific",
-			"index",
-			"class",
-			"url",
-			"spellcasting",
-			"subclass",
-			"subclass_specific",
-		},
-		"5e-SRD-Levels.json",
-	},
-	"magic_items": {
-		"magic_items",
-		[]string{
-			"index",
-			"name",
-			"equipment_category",
-			"rarity",
-			"variants",
-			"variant",
-			"desc",
-			"image",
-			"url",
-		},
-		"5e-SRD-Magic-Items.json",
-	},
-	"magic_schools": {
-		"magic_schools",
-		[]string{
-			"index",
-			"name",
-			"desc",
-			"url",
-		},
-		"5e-SRD-Magic-Schools.json",
-	},
-	"monsters": {
-		"monsters",
-		[]string{
-			"index",
-			"desc",
-			"subtype",
-			"reactions",
-			"forms",
-			"name",
-			"size",
-			"type",
-			"alignment",
-			"armor_class",
-			"hit_points",
-			"hit_dice",
-			"hit_points_roll",
-			"speed",
-			"strength",
-			"dexterity",
-			"constitution",
-			"intelligence",
-			"wisdom",
-			"charisma",
-			"proficiencies",
-			"damage_vulnerabilities",
-			"damage_resistances",
-			"damage_immunities",
-			"condition_immunities",
-			"senses",
-			"languages",
-			"challenge_rating",
-			"proficiency_bonus",
-			"xp",
-			"special_abilities",
-			"actions",
-			"legendary_actions",
-			"image",
-			"url",
-		},
-		"5e-SRD-Monsters.json",
-	},
-	"proficiencies": {
+		"class_specific",
+		"index",
+		"class",
+		"url",
+		"spellcasting",
+		"subclass",
+		"subclass_specific",
+	}},
+	"5e-SRD-Magic-Items.json": {Mapping: []string{
+		"index",
+		"name",
+		"equipment_category",
+		"rarity",
+		"variants",
+		"variant",
+		"desc",
+		"image",
+		"url",
+	}},
+	"5e-SRD-Magic-Schools.json": {Mapping: []string{
+		"index",
+		"name",
+		"desc",
+		"url",
+	}},
+	"5e-SRD-Monsters.json": {Mapping: []string{
+		"index",
+		"desc",
+		"subtype",
+		"reactions",
+		"forms",
+		"name",
+		"size",
+		"type",
+		"alignment",
+		"armor_class",
+		"hit_points",
+		"hit_dice",
+		"hit_points_roll",
+		"speed",
+		"strength",
+		"dexterity",
+		"constitution",
+		"intelligence",
+		"wisdom",
+		"charisma",
 		"proficiencies",
-		[]string{
-			"index",
-			"type",
-			"name",
-			"classes",
-			"races",
-			"url",
-			"reference",
-		},
-		"5e-SRD-Proficiencies.json",
-	},
-	"races": {
+		"damage_vulnerabilities",
+		"damage_resistances",
+		"damage_immunities",
+		"condition_immunities",
+		"senses",
+		"languages",
+		"challenge_rating",
+		"proficiency_bonus",
+		"xp",
+		"special_abilities",
+		"actions",
+		"legendary_actions",
+		"image",
+		"url",
+	}},
+	"5e-SRD-Mounts.json": {Mapping: []string{
+		"index",
+		"name",
+		"equipment_category",
+		"vehicle_category",
+		"cost",
+		"weight",
+		"desc",
+		"speed",
+		"capacity",
+		"url",
+	}},
+	"5e-SRD-Proficiencies.json": {Mapping: []string{
+		"index",
+		"type",
+		"name",
+		"classes",
 		"races",
-		[]string{
-			"language_options",
-			"ability_bonus_options",
-			"index",
-			"name",
-			"speed",
-			"ability_bonuses",
-			"alignment",
-			"age",
-			"size",
-			"size_description",
-			"starting_proficiencies",
-			"starting_proficiency_options",
-			"languages",
-			"language_desc",
-			"traits",
-			"subraces",
-			"url",
-		},
-		"5e-SRD-Races.json",
-	},
-	"rule_sections": {
-		"rule_sections",
-		[]string{
-			"name",
-			"index",
-			"desc",
-			"url",
-		},
-		"5e-SRD-Rule-Sections.json",
-	},
-	"rules": {
-		"rules",
-		[]string{
-			"name",
-			"index",
-			"desc",
-			"subsections",
-			"url",
-		},
-		"5e-SRD-Rules.json",
-	},
-	"skills": {
-		"skills",
-		[]string{
-			"index",
-			"name",
-			"desc",
-			"ability_score",
-			"url",
-		},
-		"5e-SRD-Skills.json",
-	},
-	"spells": {
-		"spells",
-		[]string{
-			"dc",
-			"heal_at_slot_level",
-			"area_of_effect",
-			"index",
-			"name",
-			"desc",
-			"higher_level",
-			"range",
-			"components",
-			"material",
-			"ritual",
-			"duration",
-			"concentration",
-			"casting_time",
-			"level",
-			"attack_type",
-			"damage",
-			"school",
-			"classes",
-			"subclasses",
-			"url",
-		},
-		"5e-SRD-Spells.json",
-	},
-	"subclasses": {
+		"url",
+		"reference",
+	}},
+	"5e-SRD-Races.json": {Mapping: []string{
+		"language_options",
+		"ability_bonus_options",
+		"index",
+		"name",
+		"speed",
+		"ability_bonuses",
+		"alignment",
+		"age",
+		"size",
+		"size_description",
+		"starting_proficiencies",
+		"starting_proficiency_options",
+		"languages",
+		"language_desc",
+		"traits",
+		"subraces",
+		"url",
+	}},
+	"5e-SRD-Rpg-Gear.json": {Mapping: []string{
+		"index",
+		"name",
+		"equipment_category",
+		"gear_category",
+		"weight",
+		"cost",
+		"desc",
+		"quantity",
+		"url",
+	}},
+	"5e-SRD-Rule-Sections.json": {Mapping: []string{
+		"name",
+		"index",
+		"desc",
+		"url",
+	}},
+	"5e-SRD-Rules.json": {Mapping: []string{
+		"name",
+		"index",
+		"desc",
+		"subsections",
+		"url",
+	}},
+	"5e-SRD-Skills.json": {Mapping: []string{
+		"index",
+		"name",
+		"desc",
+		"ability_score",
+		"url",
+	}},
+	"5e-SRD-Spells.json": {Mapping: []string{
+		"dc",
+		"heal_at_slot_level",
+		"area_of_effect",
+		"index",
+		"name",
+		"desc",
+		"higher_level",
+		"range",
+		"components",
+		"material",
+		"ritual",
+		"duration",
+		"concentration",
+		"casting_time",
+		"level",
+		"attack_type",
+		"damage",
+		"school",
+		"classes",
 		"subclasses",
-		[]string{
-			"spells",
-			"index",
-			"class",
-			"name",
-			"subclass_flavor",
-			"desc",
-			"subclass_levels",
-			"url",
-		},
-		"5e-SRD-Subclasses.json",
-	},
-	"subraces": {
+		"url",
+	}},
+	"5e-SRD-Subclasses.json": {Mapping: []string{
+		"spells",
+		"index",
+		"class",
+		"name",
+		"subclass_flavor",
+		"desc",
+		"subclass_levels",
+		"url",
+	}},
+	"5e-SRD-Subraces.json": {Mapping: []string{
+		"language_options",
+		"index",
+		"name",
+		"race",
+		"desc",
+		"ability_bonuses",
+		"starting_proficiencies",
+		"languages",
+		"racial_traits",
+		"url",
+	}},
+	"5e-SRD-Tools.json": {Mapping: []string{
+		"index",
+		"name",
+		"equipment_category",
+		"tool_category",
+		"weight",
+		"cost",
+		"desc",
+		"url",
+	}},
+	"5e-SRD-Traits.json": {Mapping: []string{
+		"proficiency_choices",
+		"trait_specific",
+		"parent",
+		"language_options",
+		"index",
+		"races",
 		"subraces",
-		[]string{
-			"language_options",
-			"index",
-			"langauge_options",
-			"name",
-			"race",
-			"desc",
-			"ability_bonuses",
-			"starting_proficiencies",
-			"languages",
-			"racial_traits",
-			"url",
-		},
-		"5e-SRD-Subraces.json",
-	},
-	"traits": {
-		"traits",
-		[]string{
-			"proficiency_choices",
-			"trait_specific",
-			"parent",
-			"language_options",
-			"index",
-			"races",
-			"subraces",
-			"name",
-			"desc",
-			"proficiencies",
-			"url",
-		},
-		"5e-SRD-Traits.json",
-	},
-	"weapon_properties": {
-		"weapon_properties",
-		[]string{
-			"index",
-			"name",
-			"desc",
-			"url",
-		},
-		"5e-SRD-Weapon-Properties.json",
-	},
+		"name",
+		"desc",
+		"proficiencies",
+		"url",
+	}},
+	"5e-SRD-Weapon-Properties.json": {Mapping: []string{
+		"index",
+		"name",
+		"desc",
+		"url",
+	}},
+	"5e-SRD-Weapons.json": {Mapping: []string{
+		"two_handed_damage",
+		"special",
+		"index",
+		"throw_range",
+		"name",
+		"equipment_category",
+		"weapon_category",
+		"weapon_range",
+		"category_range",
+		"cost",
+		"damage",
+		"range",
+		"weight",
+		"properties",
+		"url",
+	}},
+}
+
+// TABLE_NAMES and TABLES are filled in by registerTables from the files
+// discovered in 5e_data.
+var TABLE_NAMES = []string{}
+var TABLES = map[string]FiveETable{}
+
+// DriftReport lists where a file's keys no longer match a pinned mapping.
+// Extra keys are not imported; missing columns are left NULL. Conflicts are
+// later files that map to the same table, which are not imported at all.
+type DriftReport struct {
+	Table     string   `json:"table"`
+	File      string   `json:"file"`
+	Extra     []string `json:"extra,omitempty"`
+	Missing   []string `json:"missing,omitempty"`
+	Conflicts []string `json:"conflicts,omitempty"`
+}
+
+var DRIFT_REPORTS = []DriftReport{}
+
+type Dataset struct {
+	Table FiveETable
+	Data  []map[string]interface{}
+	Hash  string
+	Drift *DriftReport
+}
+
+var identifierPattern = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+// tableNameFromFile turns "5e-SRD-Ability-Scores.json" into "ability_scores".
+func tableNameFromFile(file string) string {
+	name := strings.TrimSuffix(file, filepath.Ext(file))
+	name = strings.TrimPrefix(name, "5e-SRD-")
+	name = strings.ReplaceAll(name, "-", "_")
+	return strings.ToLower(name)
+}
+
+// unionKeys returns every key used by any row, in the order first seen. Keys
+// within a row are visited in sorted order so the result is deterministic.
+func unionKeys(data []map[string]interface{}) []string {
+	seen := make(map[string]bool)
+	keys := []string{}
+	for _, row := range data {
+		rowKeys := make([]string, 0, len(row))
+		for key := range row {
+			rowKeys = append(rowKeys, key)
+		}
+		sort.Strings(rowKeys)
+		for _, key := range rowKeys {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys
+}
+
+func checkDrift(table *FiveETable, keys []string) *DriftReport {
+	report := DriftReport{Table: table.Name, File: table.file}
+
+	mapped := make(map[string]bool, len(table.Mapping))
+	for _, key := range table.Mapping {
+		mapped[key] = true
+	}
+	found := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		found[key] = true
+		if !mapped[key] {
+			report.Extra = append(report.Extra, key)
+		}
+	}
+	for _, key := range table.Mapping {
+		if !found[key] {
+			report.Missing = append(report.Missing, key)
+		}
+	}
+
+	if len(report.Extra) == 0 && len(report.Missing) == 0 {
+		return nil
+	}
+	return &report
+}
+
+// discoverDatasets loads every JSON file in dir and derives its table from
+// the file name and the union of keys in its rows, applying TABLE_OVERRIDES.
+// When two files map to the same table the first, in name order, wins.
+func discoverDatasets(dir string) ([]Dataset, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	datasets := []Dataset{}
+	byName := make(map[string]int)
+	for _, entry := range entries {
+		file := entry.Name()
+		if entry.IsDir() || filepath.Ext(file) != ".json" {
+			continue
+		}
+		log := log.WithField("file", file)
+
+		override := TABLE_OVERRIDES[file]
+		if override.Skip {
+			log.Debug("Skipping dataset")
+			continue
+		}
+
+		table := FiveETable{Name: tableNameFromFile(file), file: file}
+		if override.Name != "" {
+			table.Name = override.Name
+		}
+		if !identifierPattern.MatchString(table.Name) {
+			log.WithField("table", table.Name).Warn("Skipping dataset with invalid table name")
+			continue
+		}
+		if reservedName(table.Name) {
+			log.WithField("table", table.Name).Warn("Skipping dataset whose table name is reserved for an endpoint")
+			continue
+		}
+		if i, ok := byName[table.Name]; ok {
+			first := &datasets[i]
+			log.WithField("table", table.Name).WithField("first", first.Table.file).Error("Skipping dataset whose table name is already taken")
+			if first.Drift == nil {
+				first.Drift = &DriftReport{Table: table.Name, File: first.Table.file}
+			}
+			first.Drift.Conflicts = append(first.Drift.Conflicts, file)
+			continue
+		}
+
+		data, hash, err := loadTableData(dir, &table)
+		if err != nil {
+			log.WithError(err).Error("Failed to load JSON data")
+			return nil, err
+		}
+
+		keys := []string{}
+		for _, key := range unionKeys(data) {
+			if !identifierPattern.MatchString(key) {
+				log.WithField("key", key).Warn("Skipping key that is not a valid column name")
+				continue
+			}
+			keys = append(keys, key)
+		}
+
+		var drift *DriftReport
+		if override.Mapping != nil {
+			table.Mapping = override.Mapping
+			drift = checkDrift(&table, keys)
+		} else {
+			table.Mapping = keys
+		}
+
+		table.Types = inferColumnTypes(&table, data)
+
+		byName[table.Name] = len(datasets)
+		datasets = append(datasets, Dataset{table, data, hash, drift})
+	}
+
+	return datasets, nil
+}
+
+func registerTables(datasets []Dataset) {
+	names := make([]string, 0, len(datasets))
+	tables := make(map[string]FiveETable, len(datasets))
+	drift := []DriftReport{}
+	for _, ds := range datasets {
+		names = append(names, ds.Table.Name)
+		tables[ds.Table.Name] = ds.Table
+		if ds.Drift != nil {
+			drift = append(drift, *ds.Drift)
+		}
+	}
+	sort.Strings(names)
+
+	TABLE_NAMES = names
+	TABLES = tables
+	DRIFT_REPORTS = drift
+	URL_PATTERNS = buildUrlPatterns(datasets)
 }
 
 func convertKey(key string) string {
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"math/big"
 	"os"
+	"path/filepath"
 
 	embeddedpostgres "github.com/fergusstrange/embedded-postgres"
 	"github.com/sirupsen/logrus"
@@ -46,3 +47,12 @@ func getTestDb() (*sql.DB, *embeddedpostgres.EmbeddedPostgres, error) {
 
 	return db, postgres, nil
 }
+
+func getTestSqliteDb(dir string) (*sql.DB, error) {
+	db, err := openSqlite(filepath.Join(dir, "5e.db"))
+	if err != nil {
+		logrus.Errorf("Failed to open sqlite database: %v", err)
+		return nil, err
+	}
+	return db, nil
+}
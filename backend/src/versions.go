@@ -0,0 +1,77 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SCHEMA_VERSION is bumped whenever the importer changes how tables are laid
+// out, so existing databases are rebuilt even if the JSON did not change.
+const SCHEMA_VERSION = 4
+
+const VERSIONS_TABLE = "dataset_versions"
+
+type DatasetVersion struct {
+	Table         string    `json:"table"`
+	File          string    `json:"file"`
+	Hash          string    `json:"hash"`
+	SchemaVersion int       `json:"schema_version"`
+	ImportedAt    time.Time `json:"imported_at"`
+}
+
+func createVersionsTable(db *sql.DB) error {
+	query := "CREATE TABLE IF NOT EXISTS " + VERSIONS_TABLE + " (" +
+		"table_name TEXT PRIMARY KEY, " +
+		"file TEXT NOT NULL, " +
+		"hash TEXT NOT NULL, " +
+		"schema_version INTEGER NOT NULL, " +
+		"imported_at " + dialectFor(db).ColumnType(TIMESTAMP) + " NOT NULL);"
+
+	if _, err := db.Exec(query); err != nil {
+		log.WithError(err).Error("Failed to create versions table")
+		return err
+	}
+	return nil
+}
+
+func getDatasetVersions(db *sql.DB) (map[string]DatasetVersion, error) {
+	rows, err := db.Query("SELECT table_name, file, hash, schema_version, imported_at FROM " +
+		VERSIONS_TABLE)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := make(map[string]DatasetVersion)
+	for rows.Next() {
+		var v DatasetVersion
+		if err := rows.Scan(&v.Table, &v.File, &v.Hash, &v.SchemaVersion, &v.ImportedAt); err != nil {
+			return nil, err
+		}
+		versions[v.Table] = v
+	}
+
+	return versions, rows.Err()
+}
+
+func setDatasetVersion(tx *sql.Tx, version DatasetVersion) error {
+	log := log.WithField("table", version.Table)
+
+	_, err := tx.Exec("DELETE FROM "+VERSIONS_TABLE+" WHERE table_name = $1", version.Table)
+	if err != nil {
+		log.WithError(err).Error("Failed to clear dataset version")
+		return err
+	}
+
+	_, err = tx.Exec("INSERT INTO "+VERSIONS_TABLE+
+		" (table_name, file, hash, schema_version, imported_at) VALUES ($1, $2, $3, $4, $5)",
+		version.Table, version.File, version.Hash, version.SchemaVersion, version.ImportedAt)
+	if err != nil {
+		log.WithError(err).Error("Failed to record dataset version")
+		return err
+	}
+
+	return nil
+}